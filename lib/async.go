@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Asynchronous request pattern, see https://hl7.org/fhir/async.html
+
+const (
+	ASYNC_STATUS_PATH = "/$async-status"
+
+	ASYNC_STORAGE_MEMORY = "memory"
+	ASYNC_STORAGE_DISK   = "disk"
+
+	ASYNC_QUEUED      = "queued"
+	ASYNC_IN_PROGRESS = "in-progress"
+	ASYNC_COMPLETED   = "completed"
+)
+
+type ctxClientKey struct{}
+
+// Interactions that are run in the background when the client sends
+// Prefer: respond-async
+var asyncInteractions = []string{
+	INTERACTION_SEARCH_TYPE,
+	INTERACTION_SEARCH_SYSTEM,
+}
+
+type asyncJob struct {
+	ID      string
+	Tenant  *Tenant
+	Owner   string // Subject of the kick-off token
+	handler routeHandler
+	req     *http.Request
+	params  RouteParams
+	cancel  context.CancelFunc
+
+	mu         sync.Mutex
+	status     string
+	finishedAt time.Time
+}
+
+// asyncStore keeps the results of finished jobs
+type asyncStore interface {
+	Save(id string, result []byte) error
+	Load(id string) ([]byte, error)
+	Delete(id string)
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	results map[string][]byte
+}
+
+func (s *memoryStore) Save(id string, result []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[id] = result
+	return nil
+}
+
+func (s *memoryStore) Load(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, exists := s.results[id]
+	if !exists {
+		return nil, fmt.Errorf("no result for job %s", id)
+	}
+	return result, nil
+}
+
+func (s *memoryStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.results, id)
+}
+
+type diskStore struct {
+	dir string
+}
+
+func (s *diskStore) Save(id string, result []byte) error {
+	return os.WriteFile(filepath.Join(s.dir, id+".json"), result, 0640)
+}
+
+func (s *diskStore) Load(id string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, id+".json"))
+}
+
+func (s *diskStore) Delete(id string) {
+	os.Remove(filepath.Join(s.dir, id+".json"))
+}
+
+func newAsyncStore(storage string, dir string) (asyncStore, error) {
+	switch storage {
+	case ASYNC_STORAGE_MEMORY:
+		return &memoryStore{results: make(map[string][]byte)}, nil
+	case ASYNC_STORAGE_DISK:
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, fmt.Errorf("failed to create async result directory %s: %w", dir, err)
+		}
+		return &diskStore{dir: dir}, nil
+	}
+	return nil, fmt.Errorf("invalid async storage: %s", storage)
+}
+
+var (
+	asyncJobs   = make(map[string]*asyncJob)
+	asyncJobsMu sync.Mutex
+	asyncQueue  chan *asyncJob
+	asyncResult asyncStore
+	asyncClient *http.Client
+)
+
+// responseBuffer is a ResponseWriter that keeps the response in memory
+type responseBuffer struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) Write(data []byte) (int, error) {
+	if b.statusCode == 0 {
+		b.statusCode = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+func (b *responseBuffer) WriteHeader(statusCode int) {
+	if b.statusCode == 0 {
+		b.statusCode = statusCode
+	}
+}
+
+// httpClient returns the client for upstream requests made on behalf of req.
+// Background jobs use a client without timeout and rely on their context.
+func httpClient(req *http.Request) *http.Client {
+	if req != nil {
+		if c, ok := req.Context().Value(ctxClientKey{}).(*http.Client); ok {
+			return c
+		}
+	}
+	return client
+}
+
+// startAsyncWorkers starts the worker pool that runs queued async requests
+func startAsyncWorkers() {
+	for i := 0; i < ASYNC_WORKERS; i++ {
+		go func() {
+			for job := range asyncQueue {
+				job.run()
+			}
+		}()
+	}
+	go expireAsyncJobs()
+}
+
+// startAsync queues the request for the worker pool and answers with the
+// status URL
+func startAsync(w http.ResponseWriter, req *http.Request, handler routeHandler, params RouteParams) {
+	ctxLog := LoggerFromRequest(req)
+
+	// The body is gone once this request returns
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		SendError(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		SendError(w, "Failed to create async job", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+	ctx = context.WithValue(ctx, ctxClientKey{}, asyncClient)
+	jobReq := req.Clone(ctx)
+	jobReq.Body = io.NopCloser(bytes.NewReader(body))
+	jobReq.Header.Del("Prefer")
+
+	job := &asyncJob{
+		ID:      id,
+		Tenant:  TenantFromRequest(req),
+		Owner:   requestSubject(req),
+		handler: handler,
+		req:     jobReq,
+		params:  params,
+		cancel:  cancel,
+		status:  ASYNC_QUEUED,
+	}
+
+	asyncJobsMu.Lock()
+	asyncJobs[id] = job
+	asyncJobsMu.Unlock()
+
+	select {
+	case asyncQueue <- job:
+	default:
+		removeAsyncJob(job)
+		cancel()
+		ctxLog.Warn("Async queue full")
+		w.Header().Set("Retry-After", "30")
+		SendError(w, "Too many pending asynchronous requests", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctxLog.Info("Async request queued", "job", id, "interaction", params.Interaction)
+	w.Header().Set("Content-Location", publicBase(req)+ASYNC_STATUS_PATH+"/"+id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (job *asyncJob) run() {
+	ctxLog := LoggerFromRequest(job.req).With("job", job.ID)
+
+	job.mu.Lock()
+	if job.req.Context().Err() != nil {
+		// Cancelled while queued
+		job.mu.Unlock()
+		return
+	}
+	job.status = ASYNC_IN_PROGRESS
+	job.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(job.req.Context(), ASYNC_TIMEOUT)
+	defer cancel()
+
+	buffer := &responseBuffer{header: make(http.Header)}
+	// The result is re-encoded when the status is polled, with the
+	// format and _pretty of that request
+	writer := &formatWriter{ResponseWriter: buffer, format: FORMAT_JSON, schema: job.Tenant.Schema}
+	job.handler(writer, job.req.WithContext(ctx), job.params)
+
+	if job.req.Context().Err() != nil {
+		ctxLog.Info("Async request cancelled")
+		return
+	}
+
+	result, err := asyncResponseBundle(buffer)
+	if err == nil {
+		err = asyncResult.Save(job.ID, result)
+	}
+	if err != nil {
+		ctxLog.Error("Failed to store async result", "error", err)
+		result = OperationOutcome("exception", "Failed to store the result", nil)
+		// Keep the job pollable so the client learns about the failure
+		asyncResult.Save(job.ID, result)
+	}
+
+	if job.req.Context().Err() != nil {
+		// Deleted while the result was stored
+		asyncResult.Delete(job.ID)
+		return
+	}
+
+	job.mu.Lock()
+	job.status = ASYNC_COMPLETED
+	job.finishedAt = time.Now()
+	job.mu.Unlock()
+	ctxLog.Info("Async request completed", "status", buffer.statusCode)
+}
+
+// asyncResponseBundle wraps the buffered response in a batch-response Bundle
+func asyncResponseBundle(buffer *responseBuffer) ([]byte, error) {
+	type entryResponse struct {
+		Status   string `json:"status"`
+		Location string `json:"location,omitempty"`
+	}
+	type responseEntry struct {
+		Resource json.RawMessage `json:"resource,omitempty"`
+		Response entryResponse   `json:"response"`
+	}
+
+	statusCode := buffer.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	entry := responseEntry{
+		Response: entryResponse{
+			Status:   fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+			Location: buffer.header.Get("Location"),
+		},
+	}
+	if json.Valid(buffer.body.Bytes()) {
+		entry.Resource = buffer.body.Bytes()
+	}
+
+	bundle := map[string]interface{}{
+		"resourceType": "Bundle",
+		"type":         "batch-response",
+		"timestamp":    time.Now().UTC().Format(time.RFC3339),
+		"entry":        []responseEntry{entry},
+	}
+	return json.Marshal(bundle)
+}
+
+// lookupAsyncJob returns the async job with id if it belongs to the tenant and
+// the token subject of req
+func lookupAsyncJob(req *http.Request, id string) *asyncJob {
+	asyncJobsMu.Lock()
+	defer asyncJobsMu.Unlock()
+	job, exists := asyncJobs[id]
+	if !exists || job.Tenant != TenantFromRequest(req) || job.Owner != requestSubject(req) {
+		return nil
+	}
+	return job
+}
+
+// asyncStatusHandler returns 202 while the job is pending and the
+// batch-response Bundle once it has completed
+func asyncStatusHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	job := lookupAsyncJob(req, params.ID)
+	if job == nil {
+		SendError(w, "Async job not found", http.StatusNotFound)
+		return
+	}
+
+	job.mu.Lock()
+	status := job.status
+	job.mu.Unlock()
+
+	if status != ASYNC_COMPLETED {
+		w.Header().Set("X-Progress", status)
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	result, err := asyncResult.Load(job.ID)
+	if err != nil {
+		LoggerFromRequest(req).Error("Failed to load async result", "job", job.ID, "error", err)
+		SendError(w, "Async result not available", http.StatusGone)
+		return
+	}
+	writeFhir(w, http.StatusOK, result)
+}
+
+// asyncDeleteHandler cancels a pending job or discards a finished job's
+// result
+func asyncDeleteHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	job := lookupAsyncJob(req, params.ID)
+	if job == nil {
+		SendError(w, "Async job not found", http.StatusNotFound)
+		return
+	}
+	deleteAsyncJob(job)
+	LoggerFromRequest(req).Info("Async request deleted", "job", job.ID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func removeAsyncJob(job *asyncJob) {
+	asyncJobsMu.Lock()
+	delete(asyncJobs, job.ID)
+	asyncJobsMu.Unlock()
+}
+
+func deleteAsyncJob(job *asyncJob) {
+	removeAsyncJob(job)
+	job.cancel()
+	asyncResult.Delete(job.ID)
+}
+
+// expireAsyncJobs deletes completed jobs once they are older than
+// ASYNC_EXPIRY
+func expireAsyncJobs() {
+	for range time.Tick(time.Minute) {
+		var expired []*asyncJob
+		asyncJobsMu.Lock()
+		for _, job := range asyncJobs {
+			job.mu.Lock()
+			if job.status == ASYNC_COMPLETED && time.Since(job.finishedAt) > ASYNC_EXPIRY {
+				expired = append(expired, job)
+			}
+			job.mu.Unlock()
+		}
+		asyncJobsMu.Unlock()
+
+		for _, job := range expired {
+			log.Info("Async result expired", "job", job.ID)
+			deleteAsyncJob(job)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+// AuditEvents following the IHE Basic Audit Log Patterns (BALP), see
+// https://profiles.ihe.net/ITI/BALP/
+
+const (
+	AUDIT_SINK_STDOUT = "stdout"
+	AUDIT_FILE_PREFIX = "file:"
+
+	// Events waiting for the sink before new ones are dropped
+	AUDIT_QUEUE_SIZE = 1000
+
+	BALP_PROFILE_BASE = "https://profiles.ihe.net/ITI/BALP/StructureDefinition/IHE.BasicAudit."
+	DCM_SYSTEM        = "http://dicom.nema.org/resources/ontology/DCM"
+)
+
+// Interactions that are audited, with the AuditEvent action and BALP profile
+var auditedInteractions = map[string]struct {
+	Action  string
+	Profile string
+}{
+	INTERACTION_READ:               {"R", "Read"},
+	INTERACTION_VREAD:              {"R", "Read"},
+	INTERACTION_HISTORY_INSTANCE:   {"R", "Read"},
+	INTERACTION_HISTORY_TYPE:       {"E", "Query"},
+	INTERACTION_HISTORY_SYSTEM:     {"E", "Query"},
+	INTERACTION_SEARCH_TYPE:        {"E", "Query"},
+	INTERACTION_SEARCH_COMPARTMENT: {"E", "Query"},
+	INTERACTION_SEARCH_SYSTEM:      {"E", "Query"},
+	INTERACTION_CREATE:             {"C", "Create"},
+	INTERACTION_UPDATE:             {"U", "Update"},
+	INTERACTION_PATCH:              {"U", "Update"},
+	INTERACTION_DELETE:             {"D", "Delete"},
+	INTERACTION_BATCH:              {"E", ""},
+	INTERACTION_OPERATION:          {"E", ""},
+}
+
+// AuditEvent actions of requests without a FHIR route, like proxied paths
+var unroutedActions = map[string]string{
+	http.MethodGet:    "R",
+	http.MethodHead:   "R",
+	http.MethodPost:   "E",
+	http.MethodPut:    "U",
+	http.MethodPatch:  "U",
+	http.MethodDelete: "D",
+}
+
+// auditSink stores AuditEvents
+type auditSink interface {
+	Write(event []byte) error
+}
+
+// writerSink writes AuditEvents as NDJSON
+type writerSink struct {
+	w io.Writer
+}
+
+func (s *writerSink) Write(event []byte) error {
+	_, err := s.w.Write(append(event, '\n'))
+	return err
+}
+
+// postSink creates AuditEvents on a FHIR server
+type postSink struct {
+	url string
+}
+
+func (s *postSink) Write(event []byte) error {
+	resp, err := client.Post(s.url, FHIR_JSON_CONTENT_TYPE, bytes.NewReader(event))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("AuditEvent endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newAuditSink returns the sink for RTG_AUDIT_SINK: stdout, file:<path> or
+// the URL of an AuditEvent endpoint
+func newAuditSink(spec string) (auditSink, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == AUDIT_SINK_STDOUT:
+		return &writerSink{w: os.Stdout}, nil
+	case strings.HasPrefix(spec, AUDIT_FILE_PREFIX):
+		path := strings.TrimPrefix(spec, AUDIT_FILE_PREFIX)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit file %s: %w", path, err)
+		}
+		return &writerSink{w: file}, nil
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return &postSink{url: spec}, nil
+	}
+	return nil, fmt.Errorf("invalid audit sink: %s", spec)
+}
+
+var (
+	auditQueue chan []byte
+	auditMu    sync.RWMutex
+	auditDone  sync.WaitGroup
+)
+
+// startAuditWriter delivers queued AuditEvents to the sink, so a slow sink
+// does not hold up responses
+func startAuditWriter() {
+	if AUDIT_SINK == nil {
+		return
+	}
+	queue := make(chan []byte, AUDIT_QUEUE_SIZE)
+	auditQueue = queue
+	auditDone.Add(1)
+	go func() {
+		defer auditDone.Done()
+		for event := range queue {
+			if err := AUDIT_SINK.Write(event); err != nil {
+				log.Error("Failed to write AuditEvent", "error", err)
+			}
+		}
+	}()
+}
+
+// stopAuditWriter waits for the queued AuditEvents to be written. Requests
+// still running after the shutdown timeout record nothing.
+func stopAuditWriter() {
+	auditMu.Lock()
+	queue := auditQueue
+	auditQueue = nil
+	auditMu.Unlock()
+	if queue != nil {
+		close(queue)
+		auditDone.Wait()
+	}
+}
+
+// auditCapture receives the FHIR JSON body from writeFhir
+type auditCapture struct {
+	body []byte
+}
+
+// startAudit wraps w to capture the response for an AuditEvent. The returned
+// function records the event for the final request once the response is
+// written, so requests rejected before routing are covered as well.
+func startAudit(w http.ResponseWriter, req *http.Request, schema map[string]gql.SchemaType) (http.ResponseWriter, func(*http.Request)) {
+	if AUDIT_SINK == nil {
+		return w, func(*http.Request) {}
+	}
+
+	fw, _ := w.(*formatWriter)
+	if fw == nil {
+		fw = &formatWriter{ResponseWriter: w, format: FORMAT_JSON}
+	}
+	rec := &statusRecorder{ResponseWriter: fw.ResponseWriter, status: http.StatusOK}
+	capture := &auditCapture{}
+	wrapped := *fw
+	wrapped.ResponseWriter = rec
+	wrapped.audit = capture
+
+	return &wrapped, func(req *http.Request) {
+		params := auditRoute(req, schema)
+		action, profile, audited := auditAction(req.Method, params)
+		if !audited {
+			return
+		}
+		event := auditEvent(req, params, action, profile, rec.status, capture.body)
+		body, err := json.Marshal(event)
+		if err != nil {
+			LoggerFromRequest(req).Error("Failed to create AuditEvent", "error", err)
+			return
+		}
+		auditMu.RLock()
+		defer auditMu.RUnlock()
+		if auditQueue == nil {
+			return
+		}
+		select {
+		case auditQueue <- body:
+		default:
+			LoggerFromRequest(req).Error("Audit queue full, AuditEvent dropped", "interaction", params.Interaction)
+		}
+	}
+}
+
+// auditRoute returns the route of req. Requests rejected before routing, like
+// those with an invalid token, are matched here.
+func auditRoute(req *http.Request, schema map[string]gql.SchemaType) RouteParams {
+	if slot, ok := req.Context().Value(ctxRouteSlotKey{}).(*RouteParams); ok && slot.Interaction != "" {
+		return *slot
+	}
+	if schema != nil {
+		if route, params, _ := matchRoute(schema, req.Method, req.URL.Path); route != nil {
+			return params
+		}
+	}
+	return RouteParams{}
+}
+
+// auditAction returns the AuditEvent action and BALP profile of a route, and
+// whether it is audited. Requests without a route get the action of their
+// HTTP method.
+func auditAction(method string, params RouteParams) (string, string, bool) {
+	if params.Interaction == "" {
+		if action, exists := unroutedActions[method]; exists {
+			return action, "", true
+		}
+		return "E", "", true
+	}
+	audited, exists := auditedInteractions[params.Interaction]
+	if !exists || containsString(unscopedOperations, params.Operation) {
+		return "", "", false
+	}
+	return audited.Action, audited.Profile, true
+}
+
+func auditCoding(system string, code string, display string) map[string]interface{} {
+	return map[string]interface{}{"system": system, "code": code, "display": display}
+}
+
+// auditOutcome maps an HTTP status to the AuditEvent outcome: success, minor
+// failure for client errors and serious failure for server errors
+func auditOutcome(status int) string {
+	switch {
+	case status >= 500:
+		return "8"
+	case status >= 400:
+		return "4"
+	}
+	return "0"
+}
+
+func auditEvent(req *http.Request, params RouteParams, action string, profile string, status int, body []byte) map[string]interface{} {
+	subtype := params.Interaction
+	if params.Operation != "" {
+		subtype = params.Operation
+	}
+
+	event := map[string]interface{}{
+		"resourceType": "AuditEvent",
+		"type":         auditCoding("http://terminology.hl7.org/CodeSystem/audit-event-type", "rest", "RESTful Operation"),
+		"action":       action,
+		"recorded":     time.Now().UTC().Format(time.RFC3339Nano),
+		"outcome":      auditOutcome(status),
+		"outcomeDesc":  fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		"agent":        auditAgents(req),
+		"source": map[string]interface{}{
+			"site":     TenantFromRequest(req).String(),
+			"observer": map[string]interface{}{"display": "fhirrtg"},
+			"type": []interface{}{
+				auditCoding("http://terminology.hl7.org/CodeSystem/security-source-type", "4", "Application Server"),
+			},
+		},
+		"entity": auditEntities(req, params, body),
+	}
+	if subtype != "" {
+		event["subtype"] = []interface{}{
+			auditCoding("http://hl7.org/fhir/restful-interaction", subtype, subtype),
+		}
+	}
+	if profile != "" {
+		event["meta"] = map[string]interface{}{
+			"profile": []interface{}{BALP_PROFILE_BASE + profile},
+		}
+	}
+	return event
+}
+
+// auditAgents returns the client, the server and, with a validated token or
+// client certificate, the user
+func auditAgents(req *http.Request) []interface{} {
+	auth := AuthFromRequest(req)
+	agents := []interface{}{
+		map[string]interface{}{
+			"type":      map[string]interface{}{"coding": []interface{}{auditCoding(DCM_SYSTEM, "110153", "Source Role ID")}},
+			"who":       map[string]interface{}{"display": req.UserAgent()},
+			"requestor": auth == nil,
+			"network":   map[string]interface{}{"address": clientIP(req), "type": "2"},
+		},
+		map[string]interface{}{
+			"type":      map[string]interface{}{"coding": []interface{}{auditCoding(DCM_SYSTEM, "110152", "Destination Role ID")}},
+			"who":       map[string]interface{}{"display": "fhirrtg"},
+			"requestor": false,
+			"network":   map[string]interface{}{"address": publicBase(req), "type": "5"},
+		},
+	}
+	if auth != nil {
+		agents = append(agents, map[string]interface{}{
+			"type": map[string]interface{}{"coding": []interface{}{
+				auditCoding("http://terminology.hl7.org/CodeSystem/v3-ParticipationType", "IRCP", "information recipient"),
+			}},
+			"who":       map[string]interface{}{"identifier": map[string]interface{}{"value": auth.Subject}},
+			"requestor": true,
+		})
+	}
+	return agents
+}
+
+// auditEntities lists the resources in the response, or the resource of the
+// route if the response has none, the search query or the request URI
+// without a route, and the request id
+func auditEntities(req *http.Request, params RouteParams, body []byte) []interface{} {
+	var entities []interface{}
+	addResource := func(reference string, resourceType string) {
+		role := auditCoding("http://terminology.hl7.org/CodeSystem/object-role", "4", "Domain Resource")
+		if resourceType == "Patient" {
+			role = auditCoding("http://terminology.hl7.org/CodeSystem/object-role", "1", "Patient")
+		}
+		entities = append(entities, map[string]interface{}{
+			"what": map[string]interface{}{"reference": reference},
+			"type": auditCoding("http://terminology.hl7.org/CodeSystem/audit-entity-type", "2", "System Object"),
+			"role": role,
+		})
+	}
+
+	for _, reference := range responseResources(body) {
+		resourceType, _, _ := strings.Cut(reference, "/")
+		addResource(reference, resourceType)
+	}
+	if len(entities) == 0 && params.Type != "" && params.ID != "" {
+		addResource(params.Type+"/"+params.ID, params.Type)
+	}
+
+	if params.Interaction == "" || auditedInteractions[params.Interaction].Profile == "Query" {
+		entities = append(entities, map[string]interface{}{
+			"type":  auditCoding("http://terminology.hl7.org/CodeSystem/audit-entity-type", "2", "System Object"),
+			"role":  auditCoding("http://terminology.hl7.org/CodeSystem/object-role", "24", "Query"),
+			"query": base64.StdEncoding.EncodeToString([]byte(req.URL.RequestURI())),
+		})
+	}
+	if traceID := TraceIDFromRequest(req); traceID != "" {
+		entities = append(entities, map[string]interface{}{
+			"what": map[string]interface{}{"identifier": map[string]interface{}{"value": traceID}},
+			"type": auditCoding("https://profiles.ihe.net/ITI/BALP/CodeSystem/BasicAuditEntityType", "XrequestId", "X-Request-Id"),
+		})
+	}
+	return entities
+}
+
+// responseResources returns the Type/id of the resource in a FHIR JSON
+// response, or of the entries of a Bundle. OperationOutcomes are skipped.
+func responseResources(body []byte) []string {
+	var resource struct {
+		ResourceType string `json:"resourceType"`
+		ID           string `json:"id"`
+		Type         string `json:"type"`
+		Entry        []struct {
+			Resource struct {
+				ResourceType string `json:"resourceType"`
+				ID           string `json:"id"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	if len(body) == 0 || json.Unmarshal(body, &resource) != nil {
+		return nil
+	}
+
+	var references []string
+	if resource.ResourceType == "Bundle" && resource.Type != "" && resource.Type != "document" {
+		for _, entry := range resource.Entry {
+			if entry.Resource.ID != "" && entry.Resource.ResourceType != "OperationOutcome" {
+				references = appendUnique(references, entry.Resource.ResourceType+"/"+entry.Resource.ID)
+			}
+		}
+		return references
+	}
+	if resource.ID != "" && resource.ResourceType != "OperationOutcome" {
+		references = append(references, resource.ResourceType+"/"+resource.ID)
+	}
+	return references
+}
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+// SMART on FHIR bearer token validation, see
+// https://hl7.org/fhir/smart-app-launch/
+
+const SMART_CONFIGURATION_PATH = "/.well-known/smart-configuration"
+
+// Allowed clock skew for exp and nbf
+const AUTH_LEEWAY = time.Minute
+
+type ctxAuthKey struct{}
+
+// ctxAuthorizedKey marks requests that passed authorizeRequest
+type ctxAuthorizedKey struct{}
+
+// Operations that only need a valid token. Their job ids are unguessable and
+// bound to the tenant.
+var unscopedOperations = []string{
+	strings.TrimPrefix(EXPORT_STATUS_PATH, "/"),
+	strings.TrimPrefix(EXPORT_FILE_PATH, "/"),
+	strings.TrimPrefix(ASYNC_STATUS_PATH, "/"),
+}
+
+// SMART permissions an interaction needs
+var interactionPermissions = map[string]string{
+	INTERACTION_READ:               "r",
+	INTERACTION_VREAD:              "r",
+	INTERACTION_HISTORY_INSTANCE:   "r",
+	INTERACTION_HISTORY_TYPE:       "r",
+	INTERACTION_HISTORY_SYSTEM:     "r",
+	INTERACTION_CREATE:             "c",
+	INTERACTION_UPDATE:             "u",
+	INTERACTION_PATCH:              "u",
+	INTERACTION_DELETE:             "d",
+	INTERACTION_SEARCH_TYPE:        "s",
+	INTERACTION_SEARCH_COMPARTMENT: "s",
+	INTERACTION_SEARCH_SYSTEM:      "s",
+	INTERACTION_BATCH:              "cruds",
+	INTERACTION_OPERATION:          "r",
+}
+
+// Operations that only read data, whatever the method. Other operations sent
+// with POST may change data and need every permission, like a batch.
+var readOperations = []string{
+	"$export",
+	"$everything",
+	"$validate",
+	"$meta",
+	"$expand",
+	"$lookup",
+	"$validate-code",
+	"$subsumes",
+	"$translate",
+}
+
+// requiredPermissions returns the SMART permissions req needs on the types of
+// its route
+func requiredPermissions(req *http.Request, params RouteParams) string {
+	if params.Interaction == INTERACTION_OPERATION && req.Method != http.MethodGet && !containsString(readOperations, params.Operation) {
+		return interactionPermissions[INTERACTION_BATCH]
+	}
+	return interactionPermissions[params.Interaction]
+}
+
+// SMART v1 permissions and their v2 equivalent
+var v1Permissions = map[string]string{
+	"read":  "rs",
+	"write": "cud",
+	"*":     "cruds",
+}
+
+type authKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// loadJWKS reads the verification keys of a JWK Set file
+func loadJWKS(path string) ([]authKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file %s: %w", path, err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS file %s: %w", path, err)
+	}
+
+	var keys []authKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS file %s: %w", k.Kid, path, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys in JWKS file %s", path)
+	}
+	return keys, nil
+}
+
+func parseJWK(k jwk) (authKey, error) {
+	key := authKey{kid: k.Kid, alg: k.Alg}
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return key, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return key, err
+		}
+		key.key = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return key, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return key, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return key, err
+		}
+		key.key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return key, err
+		}
+		key.key = secret
+	default:
+		return key, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+	return key, nil
+}
+
+// audience is a JWT aud claim, a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// authContext is the validated token of a request
+type authContext struct {
+	Subject string
+	Patient string
+	Scopes  []smartScope
+
+	// Launch patient the request is limited to by patient scopes
+	restrictPatient string
+}
+
+type smartScope struct {
+	Context      string
+	ResourceType string
+	Permissions  string
+}
+
+// parseScopes reads the SMART v1 and v2 resource scopes of a scope claim.
+// Scopes with search restrictions are not supported and ignored.
+func parseScopes(scope string) []smartScope {
+	var scopes []smartScope
+	for _, s := range strings.Fields(scope) {
+		scopeContext, rest, found := strings.Cut(s, "/")
+		if !found || (scopeContext != "patient" && scopeContext != "user" && scopeContext != "system") {
+			continue
+		}
+		resourceType, permissions, found := strings.Cut(rest, ".")
+		if !found || strings.Contains(permissions, "?") {
+			continue
+		}
+		if v2, isV1 := v1Permissions[permissions]; isV1 {
+			permissions = v2
+		} else if strings.Trim(permissions, "cruds") != "" {
+			continue
+		}
+		scopes = append(scopes, smartScope{Context: scopeContext, ResourceType: resourceType, Permissions: permissions})
+	}
+	return scopes
+}
+
+// Access levels a token grants for a resource type
+const (
+	accessNone = iota
+	accessPatient
+	accessFull
+)
+
+// access returns the level at which the scopes grant all permissions on
+// resourceType. Patient scopes only grant access to the launch patient's
+// data.
+func (a *authContext) access(resourceType string, permissions string) int {
+	level := accessFull
+	for _, permission := range permissions {
+		best := accessNone
+		for _, scope := range a.Scopes {
+			if scope.ResourceType != "*" && scope.ResourceType != resourceType {
+				continue
+			}
+			if !strings.ContainsRune(scope.Permissions, permission) {
+				continue
+			}
+			if scope.Context == "patient" {
+				best = max(best, accessPatient)
+			} else {
+				best = accessFull
+			}
+		}
+		level = min(level, best)
+	}
+	return level
+}
+
+// authError is a failed authentication (401) or authorization (403)
+type authError struct {
+	status int
+	msg    string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+func sendAuthError(w http.ResponseWriter, req *http.Request, err *authError) {
+	if err.status == http.StatusUnauthorized {
+		if req.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		}
+		SendIssue(w, "login", err.msg, err.status)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+	SendIssue(w, "forbidden", err.msg, err.status)
+}
+
+// authEnabled reports whether requests need a bearer token or a mapped
+// client certificate
+func authEnabled() bool {
+	return len(AUTH_KEYS) > 0 || len(TLS_CLIENT_IDENTITIES) > 0
+}
+
+// AuthFromRequest returns the validated token of req, nil without one
+func AuthFromRequest(r *http.Request) *authContext {
+	auth, _ := r.Context().Value(ctxAuthKey{}).(*authContext)
+	return auth
+}
+
+// requestSubject returns the subject of the token of req, empty without one
+func requestSubject(r *http.Request) string {
+	if auth := AuthFromRequest(r); auth != nil {
+		return auth.Subject
+	}
+	return ""
+}
+
+// authenticate validates the bearer token of req. Requests without a token
+// pass and are rejected by authorizeRequest unless the route is public.
+func authenticate(req *http.Request) (*http.Request, *authError) {
+	if !authEnabled() {
+		return req, nil
+	}
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return req, nil
+	}
+	scheme, token, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return req, &authError{http.StatusUnauthorized, "Authorization must be a bearer token"}
+	}
+
+	claims, err := validateToken(strings.TrimSpace(token), time.Now())
+	if err != nil {
+		LoggerFromRequest(req).Info("Invalid bearer token", "error", err)
+		return req, &authError{http.StatusUnauthorized, "Invalid bearer token"}
+	}
+
+	auth := &authContext{
+		Subject: claims.Subject,
+		Patient: claims.Patient,
+		Scopes:  parseScopes(claims.Scope),
+	}
+	return withAuth(req, auth), nil
+}
+
+func withAuth(req *http.Request, auth *authContext) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), ctxAuthKey{}, auth))
+}
+
+// authorizeRequest checks the token scopes against the interaction and
+// resource types of the route
+func authorizeRequest(req *http.Request, params RouteParams) (*http.Request, *authError) {
+	if !authEnabled() || params.Interaction == INTERACTION_CAPABILITIES {
+		return withAuthorized(req), nil
+	}
+	auth := AuthFromRequest(req)
+	if auth == nil {
+		return req, &authError{http.StatusUnauthorized, "Authentication required"}
+	}
+	if containsString(unscopedOperations, params.Operation) {
+		return withAuthorized(req), nil
+	}
+
+	permissions := requiredPermissions(req, params)
+	level := accessFull
+	for _, resourceType := range scopeTypes(req, params) {
+		level = min(level, auth.access(resourceType, permissions))
+	}
+	switch level {
+	case accessNone:
+		return req, &authError{http.StatusForbidden, fmt.Sprintf("Insufficient scope for %s", params.Interaction)}
+	case accessFull:
+		return withAuthorized(req), nil
+	}
+
+	if err := checkPatientContext(auth, params); err != nil {
+		return req, err
+	}
+	if containsString(instanceInteractions, params.Interaction) && params.Type != "Patient" {
+		inCompartment, err := inPatientCompartment(req, params.Type, params.ID, auth.Patient)
+		if err != nil {
+			LoggerFromRequest(req).Error("Failed to check the patient compartment", "error", err)
+			return req, &authError{http.StatusForbidden, "Access to the resource could not be verified"}
+		}
+		if !inCompartment {
+			return req, &authError{http.StatusForbidden, "Access is limited to the launch patient"}
+		}
+	}
+	restricted := *auth
+	restricted.restrictPatient = auth.Patient
+	return withAuthorized(withAuth(req, &restricted)), nil
+}
+
+func withAuthorized(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), ctxAuthorizedKey{}, true))
+}
+
+// requestAuthorized reports whether req passed authorization, which every
+// request does when auth is disabled
+func requestAuthorized(req *http.Request) bool {
+	if !authEnabled() {
+		return true
+	}
+	authorized, _ := req.Context().Value(ctxAuthorizedKey{}).(bool)
+	return authorized
+}
+
+// scopeTypes returns the resource types the interaction acts on, * for all
+func scopeTypes(req *http.Request, params RouteParams) []string {
+	switch {
+	case params.Interaction == INTERACTION_SEARCH_SYSTEM:
+		var types []string
+		for _, value := range req.URL.Query()["_type"] {
+			for _, resourceType := range strings.Split(value, ",") {
+				if resourceType = strings.TrimSpace(resourceType); resourceType != "" {
+					types = append(types, resourceType)
+				}
+			}
+		}
+		if len(types) > 0 {
+			return types
+		}
+	case params.Interaction == INTERACTION_SEARCH_COMPARTMENT:
+		return []string{params.Compartment}
+	case params.Type != "":
+		return []string{params.Type}
+	}
+	return []string{"*"}
+}
+
+// Interactions on a single resource, which patient scopes only allow on the
+// launch patient's compartment
+var instanceInteractions = []string{
+	INTERACTION_READ,
+	INTERACTION_VREAD,
+	INTERACTION_UPDATE,
+	INTERACTION_PATCH,
+	INTERACTION_DELETE,
+	INTERACTION_HISTORY_INSTANCE,
+}
+
+// checkPatientContext limits patient scopes to the launch patient. Type
+// searches are restricted in fhirSearch and instances of other types than
+// Patient are checked with inPatientCompartment.
+func checkPatientContext(auth *authContext, params RouteParams) *authError {
+	if auth.Patient == "" {
+		return &authError{http.StatusForbidden, "Patient scopes require a patient in the launch context"}
+	}
+	switch params.Interaction {
+	case INTERACTION_SEARCH_TYPE, INTERACTION_CREATE:
+		return nil
+	case INTERACTION_READ, INTERACTION_VREAD, INTERACTION_UPDATE, INTERACTION_PATCH,
+		INTERACTION_DELETE, INTERACTION_HISTORY_INSTANCE, INTERACTION_SEARCH_COMPARTMENT:
+		if params.Type == "Patient" && params.ID != auth.Patient {
+			return &authError{http.StatusForbidden, "Access is limited to the launch patient"}
+		}
+		if params.Interaction == INTERACTION_SEARCH_COMPARTMENT && params.Type != "Patient" {
+			return &authError{http.StatusForbidden, "Patient scopes only allow Patient compartment searches"}
+		}
+		return nil
+	}
+	return &authError{http.StatusForbidden, fmt.Sprintf("%s is not available with patient scopes", params.Interaction)}
+}
+
+// inPatientCompartment reports whether resourceType/id is in the compartment
+// of patient, by searching for it with the patient reference
+func inPatientCompartment(req *http.Request, resourceType string, id string, patient string) (bool, error) {
+	param := patientSearchParam(TenantFromRequest(req).Schema, resourceType)
+	if param == "" {
+		return false, nil
+	}
+
+	fragment := gql.Fragment{Name: resourceType + "IdFragment", Type: resourceType, Fields: []gql.Field{{Name: "id"}}}
+	searchParams := gql.Arguments{
+		"_id": gql.ArgumentValue{Value: id},
+		param: gql.ArgumentValue{Value: "Patient/" + patient},
+	}
+	query := FullResourceRequest(resourceType, searchParams, nil, nil, map[string]gql.Fragment{resourceType: fragment})
+
+	response, err := GqlRequest(fragment.String()+"\n"+query.String(), "", req)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+	if response.StatusCode >= 400 {
+		return false, fmt.Errorf("upstream returned status %d", response.StatusCode)
+	}
+
+	var result struct {
+		Data map[string]struct {
+			Edges []struct {
+				Node struct {
+					ID string `json:"id"`
+				} `json:"node"`
+			} `json:"edges"`
+		} `json:"data"`
+		Errors []graphQLError `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false, err
+	}
+	if len(result.Errors) > 0 {
+		return false, fmt.Errorf("upstream returned an error: %s", result.Errors[0].Message)
+	}
+	for _, edge := range result.Data[resourceType+"Connection"].Edges {
+		if edge.Node.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorizeTypes checks the scopes for resource types an interaction reaches
+// beyond its route, like included or exported types
+func authorizeTypes(req *http.Request, resourceTypes []string, permissions string) *authError {
+	if !authEnabled() {
+		return nil
+	}
+	auth := AuthFromRequest(req)
+	if auth == nil {
+		return &authError{http.StatusUnauthorized, "Authentication required"}
+	}
+	for _, resourceType := range resourceTypes {
+		if auth.access(resourceType, permissions) == accessNone {
+			return &authError{http.StatusForbidden, fmt.Sprintf("Insufficient scope for %s", resourceType)}
+		}
+	}
+	return nil
+}
+
+// restrictSearchToPatient adds the launch patient to the query of a type
+// search made with patient scopes
+func restrictSearchToPatient(req *http.Request, resourceType string) (*http.Request, *authError) {
+	auth := AuthFromRequest(req)
+	if auth == nil || auth.restrictPatient == "" {
+		return req, nil
+	}
+
+	param, value := "_id", auth.restrictPatient
+	if resourceType != "Patient" {
+		param = patientSearchParam(TenantFromRequest(req).Schema, resourceType)
+		value = "Patient/" + auth.restrictPatient
+	}
+	if param == "" {
+		return req, &authError{http.StatusForbidden, fmt.Sprintf("%s cannot be searched with patient scopes", resourceType)}
+	}
+
+	query := req.URL.Query()
+	query.Set(param, value)
+	restricted := req.Clone(req.Context())
+	restricted.URL.RawQuery = query.Encode()
+	return restricted, nil
+}
+
+type tokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expires   *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Patient   string   `json:"patient"`
+}
+
+// validateToken verifies the signature and claims of a compact JWS token
+func validateToken(token string, now time.Time) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	verified := false
+	for _, key := range AUTH_KEYS {
+		if (header.Kid != "" && key.kid != "" && key.kid != header.Kid) || (key.alg != "" && key.alg != header.Alg) {
+			continue
+		}
+		if verifySignature(header.Alg, key.key, signingInput, signature) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("signature verification failed for alg %s", header.Alg)
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	if claims.Expires == nil {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(int64(*claims.Expires), 0).Add(AUTH_LEEWAY)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(AUTH_LEEWAY).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if AUTH_ISSUER != "" && claims.Issuer != AUTH_ISSUER {
+		return nil, fmt.Errorf("unexpected issuer %s", claims.Issuer)
+	}
+	if AUTH_AUDIENCE != "" && !containsString(claims.Audience, AUTH_AUDIENCE) {
+		return nil, fmt.Errorf("token is not for audience %s", AUTH_AUDIENCE)
+	}
+	return &claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(alg string, key interface{}, signingInput string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if ecdsa.Verify(k, digest, r, s) {
+			return nil
+		}
+	case []byte:
+		if alg[:2] != "HS" {
+			break
+		}
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signingInput))
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature")
+}
+
+// smartConfigurationHandler serves the SMART discovery document
+func smartConfigurationHandler(w http.ResponseWriter, req *http.Request) {
+	config := map[string]interface{}{
+		"grant_types_supported":            []string{"authorization_code", "client_credentials"},
+		"response_types_supported":         []string{"code"},
+		"code_challenge_methods_supported": []string{"S256"},
+		"scopes_supported": []string{
+			"openid", "fhirUser", "launch", "launch/patient", "offline_access",
+			"patient/*.cruds", "user/*.cruds", "system/*.cruds",
+		},
+		"capabilities": []string{
+			"launch-ehr", "launch-standalone", "client-public", "client-confidential-symmetric",
+			"client-confidential-asymmetric", "context-ehr-patient", "context-standalone-patient",
+			"permission-patient", "permission-user", "permission-v1", "permission-v2",
+		},
+	}
+	if AUTH_ISSUER != "" {
+		config["issuer"] = AUTH_ISSUER
+	}
+	if AUTH_AUTHORIZE_URL != "" {
+		config["authorization_endpoint"] = AUTH_AUTHORIZE_URL
+	}
+	if AUTH_TOKEN_URL != "" {
+		config["token_endpoint"] = AUTH_TOKEN_URL
+	}
+
+	body, err := json.Marshal(config)
+	if err != nil {
+		SendError(w, "Failed to create SMART configuration", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
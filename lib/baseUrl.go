@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type ctxBasePathKey struct{}
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR
+// ranges. "*" trusts every peer.
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+			continue
+		case item == "*":
+			_, all4, _ := net.ParseCIDR("0.0.0.0/0")
+			_, all6, _ := net.ParseCIDR("::/0")
+			nets = append(nets, all4, all6)
+		case strings.Contains(item, "/"):
+			_, ipNet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", item)
+			}
+			nets = append(nets, ipNet)
+		default:
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", item)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return nets, nil
+}
+
+// fromTrustedProxy reports whether the direct peer of req is a trusted
+// reverse proxy whose forwarding headers may be believed
+func fromTrustedProxy(req *http.Request) bool {
+	if len(TRUSTED_PROXIES) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range TRUSTED_PROXIES {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded returns the parameters of the first element of an RFC 7239
+// Forwarded header
+func parseForwarded(header string) map[string]string {
+	params := make(map[string]string)
+	first, _, _ := strings.Cut(header, ",")
+	for _, pair := range strings.Split(first, ";") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			continue
+		}
+		params[strings.ToLower(key)] = strings.Trim(value, `"`)
+	}
+	return params
+}
+
+func firstHeaderValue(req *http.Request, name string) string {
+	value, _, _ := strings.Cut(req.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// withBasePath records the path prefix stripped from req so that absolute
+// URLs handed back to the client can include it again
+func withBasePath(req *http.Request, basePath string) *http.Request {
+	ctx := context.WithValue(req.Context(), ctxBasePathKey{}, basePath)
+	return req.WithContext(ctx)
+}
+
+func basePath(req *http.Request) string {
+	if prefix, ok := req.Context().Value(ctxBasePathKey{}).(string); ok {
+		return prefix
+	}
+	return ""
+}
+
+// publicBase is the base URL clients use to reach this server. It is either
+// the configured RTG_PUBLIC_BASE_URL, with the tenant segment of req, or
+// derived from the request, honouring Forwarded and X-Forwarded-* headers set
+// by a trusted proxy.
+func publicBase(req *http.Request) string {
+	if PUBLIC_BASE_URL != "" {
+		return configuredPublicBase(req)
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host := req.Host
+	prefix := ""
+
+	if fromTrustedProxy(req) {
+		forwarded := parseForwarded(req.Header.Get("Forwarded"))
+		if proto := forwarded["proto"]; proto != "" {
+			scheme = proto
+		} else if proto := firstHeaderValue(req, "X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+		if fwdHost := forwarded["host"]; fwdHost != "" {
+			host = fwdHost
+		} else if fwdHost := firstHeaderValue(req, "X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+		prefix = strings.TrimSuffix(firstHeaderValue(req, "X-Forwarded-Prefix"), "/")
+	}
+
+	return scheme + "://" + host + prefix + basePath(req)
+}
+
+// configuredPublicBase adds the tenant segment of req to RTG_PUBLIC_BASE_URL,
+// which is the base of the default tenant. The segment goes before the base
+// path if the URL ends with it, like the request path.
+func configuredPublicBase(req *http.Request) string {
+	tenantPrefix := strings.TrimSuffix(basePath(req), BASE_PATH)
+	if tenantPrefix == "" {
+		return PUBLIC_BASE_URL
+	}
+	if base, found := strings.CutSuffix(PUBLIC_BASE_URL, BASE_PATH); found && BASE_PATH != "" {
+		return base + tenantPrefix + BASE_PATH
+	}
+	return PUBLIC_BASE_URL + tenantPrefix
+}
+
+// publicURL is the absolute public URL of req itself
+func publicURL(req *http.Request) string {
+	url := publicBase(req) + req.URL.Path
+	if req.URL.RawQuery != "" {
+		url += "?" + req.URL.RawQuery
+	}
+	return url
+}
+
+// rewriteReferences rewrites Reference.reference values that point at the
+// upstream server so they point at the public base instead
+func rewriteReferences(v interface{}, upstreamBase string, publicBase string) {
+	switch data := v.(type) {
+	case map[string]interface{}:
+		for key, value := range data {
+			if ref, ok := value.(string); ok && key == "reference" {
+				data[key] = rewriteUpstreamURL(ref, upstreamBase, publicBase)
+				continue
+			}
+			rewriteReferences(value, upstreamBase, publicBase)
+		}
+	case []interface{}:
+		for _, item := range data {
+			rewriteReferences(item, upstreamBase, publicBase)
+		}
+	}
+}
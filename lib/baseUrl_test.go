@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicBaseWithTenants(t *testing.T) {
+	savedPublicBase, savedBasePath, savedTenants, savedDefault := PUBLIC_BASE_URL, BASE_PATH, tenants, defaultTenant
+	defer func() {
+		PUBLIC_BASE_URL, BASE_PATH, tenants, defaultTenant = savedPublicBase, savedBasePath, savedTenants, savedDefault
+	}()
+	defaultTenant = &Tenant{Upstream: "http://default/graphql"}
+	tenants = map[string]*Tenant{"acme": {Name: "acme", Upstream: "http://acme/graphql"}}
+
+	tests := []struct {
+		name       string
+		publicBase string
+		basePath   string
+		path       string
+		expect     string
+	}{
+		{"default tenant", "https://api.example.org/fhir", "/fhir", "/fhir/Patient?name=x", "https://api.example.org/fhir/Patient?name=x"},
+		{"tenant", "https://api.example.org/fhir", "/fhir", "/acme/fhir/Patient?name=x", "https://api.example.org/acme/fhir/Patient?name=x"},
+		{"tenant behind a prefix", "https://example.org/api/fhir", "/fhir", "/acme/fhir/Patient/1", "https://example.org/api/acme/fhir/Patient/1"},
+		{"public URL without base path", "https://fhir.example.org", "/fhir", "/acme/fhir/Patient/1", "https://fhir.example.org/acme/Patient/1"},
+		{"no base path", "https://api.example.org", "", "/acme/Patient/1", "https://api.example.org/acme/Patient/1"},
+		{"derived from the request", "", "/fhir", "/acme/fhir/Patient/1", "http://rtg.local/acme/fhir/Patient/1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			PUBLIC_BASE_URL, BASE_PATH = test.publicBase, test.basePath
+			req, tenant := routeRequest(httptest.NewRequest("GET", "http://rtg.local"+test.path, nil))
+			if tenant == nil {
+				t.Fatalf("no tenant for %s", test.path)
+			}
+			if url := publicURL(req); url != test.expect {
+				t.Errorf("got %s, expected %s", url, test.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Ways of reporting included references that cannot become entries of their
+// own, see RTG_UNRESOLVED_REFERENCES
+const (
+	UNRESOLVED_CONTAINED = "contained"
+	UNRESOLVED_OUTCOME   = "outcome"
+)
+
+func parseUnresolvedReferences(value string) ([]string, error) {
+	var options []string
+	for _, option := range strings.Split(value, ",") {
+		option = strings.ToLower(strings.TrimSpace(option))
+		switch option {
+		case "":
+			continue
+		case UNRESOLVED_CONTAINED, UNRESOLVED_OUTCOME:
+			options = appendUnique(options, option)
+		default:
+			return nil, fmt.Errorf("invalid unresolved reference handling: %s", option)
+		}
+	}
+	return options, nil
+}
+
+// entryCollector builds the entries of a searchset Bundle. Each resource is
+// listed once, keyed by type, id and version; a match always wins over an
+// include of the same resource.
+type entryCollector struct {
+	baseUrl    string
+	entries    []FhirEntry
+	index      map[string]int
+	contained  int
+	unresolved []string
+}
+
+func resourceKey(resource map[string]interface{}) string {
+	resourceType, _ := resource["resourceType"].(string)
+	id, _ := resource["id"].(string)
+	if resourceType == "" || id == "" {
+		return ""
+	}
+	version := ""
+	if meta, ok := resource["meta"].(map[string]interface{}); ok {
+		version, _ = meta["versionId"].(string)
+	}
+	return resourceType + "/" + id + "/" + version
+}
+
+func (c *entryCollector) add(resource map[string]interface{}, mode string) {
+	key := resourceKey(resource)
+	if key == "" {
+		return
+	}
+	if i, exists := c.index[key]; exists {
+		if mode == "match" {
+			c.entries[i].Search.Mode = mode
+		}
+		return
+	}
+	c.index[key] = len(c.entries)
+	c.entries = append(c.entries, createEntry(resource, c.baseUrl, mode))
+}
+
+// collectEntries turns a GraphQL search response into Bundle entries. Nodes
+// of the matchField connections are matches, listed first in response order,
+// followed by the nodes of other connections and Reference.resource
+// expansions as includes. issues are reported in an outcome entry, together
+// with unresolved references.
+func collectEntries(data map[string]interface{}, baseUrl string, matchField func(string) bool, issues []interface{}) []FhirEntry {
+	c := &entryCollector{baseUrl: baseUrl, index: make(map[string]int)}
+
+	fields := make([]string, 0, len(data))
+	for field := range data {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		if matchField(field) {
+			for _, node := range connectionNodes(data[field]) {
+				c.add(node, "match")
+			}
+		}
+	}
+	for _, field := range fields {
+		if !matchField(field) {
+			for _, node := range connectionNodes(data[field]) {
+				c.add(node, "include")
+			}
+		}
+		c.walk(data[field], nil)
+	}
+
+	if containsString(UNRESOLVED_REFERENCES, UNRESOLVED_OUTCOME) {
+		issues = append(issues, unresolvedIssues(c.unresolved)...)
+	}
+	if len(issues) > 0 {
+		c.entries = append(c.entries, FhirEntry{
+			Resource: outcomeResource(issues),
+			Search:   &FhirEntrySearch{Mode: "outcome"},
+		})
+	}
+	return c.entries
+}
+
+func connectionNodes(connection interface{}) []map[string]interface{} {
+	var nodes []map[string]interface{}
+	connectionMap, _ := connection.(map[string]interface{})
+	edges, _ := connectionMap["edges"].([]interface{})
+	for _, edge := range edges {
+		edgeMap, _ := edge.(map[string]interface{})
+		if node, ok := edgeMap["node"].(map[string]interface{}); ok {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// walk looks for Reference.resource expansions below value. owner is the
+// resource the value belongs to.
+func (c *entryCollector) walk(value interface{}, owner map[string]interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			c.walk(item, owner)
+		}
+	case map[string]interface{}:
+		if resourceType, _ := v["resourceType"].(string); resourceType != "" {
+			owner = v
+		}
+		if resource, isExpansion := v["resource"]; isExpansion && v["reference"] != nil {
+			c.resolve(v, resource, owner)
+		}
+		for key, child := range v {
+			if key != "resource" {
+				c.walk(child, owner)
+			}
+		}
+	}
+}
+
+func (c *entryCollector) resolve(reference map[string]interface{}, resource interface{}, owner map[string]interface{}) {
+	referenceStr, _ := reference["reference"].(string)
+	resourceMap, _ := resource.(map[string]interface{})
+
+	if resourceMap == nil {
+		if !strings.HasPrefix(referenceStr, "#") {
+			c.unresolved = appendUnique(c.unresolved, referenceStr)
+		}
+		return
+	}
+
+	if resourceKey(resourceMap) != "" {
+		c.add(resourceMap, "include")
+		c.walk(resourceMap, resourceMap)
+		return
+	}
+
+	// Without an id the resource cannot be an entry of its own
+	if containsString(UNRESOLVED_REFERENCES, UNRESOLVED_CONTAINED) && owner != nil && owner["id"] != nil {
+		c.contained++
+		localID := fmt.Sprintf("inc%d", c.contained)
+		resourceMap["id"] = localID
+		contained, _ := owner["contained"].([]interface{})
+		owner["contained"] = append(contained, resourceMap)
+		reference["reference"] = "#" + localID
+		delete(reference, "resource")
+		// Contained resources cannot contain others, so its references are
+		// contained in the same owner
+		for key, child := range resourceMap {
+			if key != "resource" {
+				c.walk(child, owner)
+			}
+		}
+		return
+	}
+	c.unresolved = appendUnique(c.unresolved, referenceStr)
+}
+
+// unresolvedIssues reports included references the upstream did not resolve
+func unresolvedIssues(references []string) []interface{} {
+	issues := make([]interface{}, 0, len(references))
+	for _, reference := range references {
+		issues = append(issues, map[string]interface{}{
+			"severity":    "warning",
+			"code":        "not-found",
+			"diagnostics": fmt.Sprintf("Included reference %s could not be resolved", reference),
+		})
+	}
+	return issues
+}
+
+// searchMatchField returns which top level fields of a search response hold
+// the matches: the searched type's connection, or every field of a system
+// search
+func searchMatchField(req *http.Request) func(string) bool {
+	resourceType := RouteFromRequest(req).Type
+	return func(field string) bool {
+		return resourceType == "" || field == resourceType || field == resourceType+"Connection"
+	}
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+// Bulk Data export, see https://hl7.org/fhir/uv/bulkdata/export.html
+
+const (
+	EXPORT_STATUS_PATH  = "/$export-status"
+	EXPORT_FILE_PATH    = "/$export-file"
+	NDJSON_CONTENT_TYPE = "application/fhir+ndjson"
+
+	EXPORT_IN_PROGRESS = "in-progress"
+	EXPORT_COMPLETED   = "completed"
+	EXPORT_FAILED      = "failed"
+)
+
+var exportOutputFormats = []string{"application/fhir+ndjson", "application/ndjson", "ndjson"}
+
+type exportOutput struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Count int    `json:"count"`
+}
+
+type exportManifest struct {
+	TransactionTime     string         `json:"transactionTime"`
+	Request             string         `json:"request"`
+	RequiresAccessToken bool           `json:"requiresAccessToken"`
+	Output              []exportOutput `json:"output"`
+	Error               []exportOutput `json:"error"`
+}
+
+// exportJob is one running or finished $export. Output files are written to
+// their own directory below EXPORT_DIR.
+type exportJob struct {
+	ID              string
+	Tenant          *Tenant
+	Types           []string
+	Since           string
+	TypeFilters     map[string][]url.Values
+	Patients        []string // Group members, nil exports all patients
+	Request         string
+	PublicBase      string
+	Owner           string // Subject of the kick-off token
+	TransactionTime time.Time
+
+	dir    string
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	status     string
+	progress   string
+	err        error
+	deleted    bool
+	finishedAt time.Time
+	output     []exportOutput
+	errors     []exportOutput
+}
+
+var (
+	exportJobs   = make(map[string]*exportJob)
+	exportJobsMu sync.Mutex
+)
+
+// exportHandler kicks off an export at system, Patient or Group level. Other
+// resource types have no $export and are passed on to the upstream.
+func exportHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	switch {
+	case params.Type == "":
+	case params.Type == "Patient" && params.ID == "":
+	case params.Type == "Group" && params.ID != "":
+	default:
+		ProxyRequest(w, req)
+		return
+	}
+	fhirExport(w, req, params)
+}
+
+func fhirExport(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	ctxLog := LoggerFromRequest(req)
+	tenant := TenantFromRequest(req)
+	schema := tenant.Schema
+
+	if !preferRespondAsync(req) {
+		SendError(w, "$export requires the Prefer: respond-async header", http.StatusBadRequest)
+		return
+	}
+
+	queryString, err := exportParameters(req)
+	if err != nil {
+		SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if outputFormat := queryString.Get("_outputFormat"); outputFormat != "" {
+		if !containsString(exportOutputFormats, strings.ReplaceAll(outputFormat, " ", "+")) {
+			SendError(w, fmt.Sprintf("unsupported _outputFormat: %s", outputFormat), http.StatusBadRequest)
+			return
+		}
+	}
+
+	since := queryString.Get("_since")
+	if since != "" {
+		if _, err := time.Parse(time.RFC3339, since); err != nil {
+			SendError(w, fmt.Sprintf("invalid _since: %s", since), http.StatusBadRequest)
+			return
+		}
+	}
+
+	available := searchableTypes(schema)
+	if params.Type != "" {
+		available = patientCompartmentTypes(schema)
+	}
+	resourceTypes := available
+	if typeParams, exists := queryString["_type"]; exists {
+		resourceTypes = nil
+		for _, typeParam := range typeParams {
+			for _, resourceType := range strings.Split(typeParam, ",") {
+				resourceType = strings.TrimSpace(resourceType)
+				if resourceType == "" {
+					continue
+				}
+				if !containsString(available, resourceType) {
+					SendError(w, fmt.Sprintf("resource type %s cannot be exported", resourceType), http.StatusBadRequest)
+					return
+				}
+				resourceTypes = appendUnique(resourceTypes, resourceType)
+			}
+		}
+	}
+	if len(resourceTypes) == 0 {
+		SendError(w, "No resource types to export", http.StatusBadRequest)
+		return
+	}
+	if authErr := authorizeTypes(req, resourceTypes, "r"); authErr != nil {
+		sendAuthError(w, req, authErr)
+		return
+	}
+
+	typeFilters, err := parseTypeFilters(queryString["_typeFilter"], resourceTypes)
+	if err != nil {
+		SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var patients []string
+	if params.Type == "Group" {
+		patients, err = groupPatients(req, params.ID)
+		if err != nil {
+			SendError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		SendError(w, "Failed to create export job", http.StatusInternalServerError)
+		return
+	}
+	job := &exportJob{
+		ID:              id,
+		Tenant:          tenant,
+		Types:           resourceTypes,
+		Since:           since,
+		TypeFilters:     typeFilters,
+		Patients:        patients,
+		Request:         publicURL(req),
+		PublicBase:      publicBase(req),
+		Owner:           requestSubject(req),
+		TransactionTime: time.Now().UTC(),
+		dir:             filepath.Join(EXPORT_DIR, id),
+		status:          EXPORT_IN_PROGRESS,
+	}
+	if err := os.MkdirAll(job.dir, 0750); err != nil {
+		ctxLog.Error("Failed to create export directory", "error", err)
+		SendError(w, "Failed to create export job", http.StatusInternalServerError)
+		return
+	}
+
+	// The job outlives the kick-off request but keeps its logger, tenant and
+	// headers for the upstream requests
+	ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+	job.cancel = cancel
+	jobReq := req.Clone(ctx)
+	jobReq.Body = http.NoBody
+
+	exportJobsMu.Lock()
+	exportJobs[id] = job
+	exportJobsMu.Unlock()
+
+	ctxLog.Info("Export started", "job", id, "types", resourceTypes)
+	go job.run(jobReq)
+
+	w.Header().Set("Content-Location", job.PublicBase+EXPORT_STATUS_PATH+"/"+id)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// preferRespondAsync reports whether the client asked for the asynchronous
+// request pattern
+func preferRespondAsync(req *http.Request) bool {
+	for _, prefer := range req.Header.Values("Prefer") {
+		for _, token := range strings.Split(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exportParameters merges the query string with the parameters of a POSTed
+// Parameters resource
+func exportParameters(req *http.Request) (url.Values, error) {
+	values := req.URL.Query()
+	if req.Method != http.MethodPost {
+		return values, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body")
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		return values, nil
+	}
+	if isXMLContentType(req.Header.Get("Content-Type")) {
+		body, err = fhirXMLToJSON(body, TenantFromRequest(req).Schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid XML: %s", err)
+		}
+	}
+
+	var parameters struct {
+		ResourceType string                   `json:"resourceType"`
+		Parameter    []map[string]interface{} `json:"parameter"`
+	}
+	if err := json.Unmarshal(body, &parameters); err != nil || parameters.ResourceType != "Parameters" {
+		return nil, fmt.Errorf("request body must be a Parameters resource")
+	}
+	for _, parameter := range parameters.Parameter {
+		name, _ := parameter["name"].(string)
+		for key, value := range parameter {
+			if s, ok := value.(string); ok && strings.HasPrefix(key, "value") {
+				values.Add(name, s)
+			}
+		}
+	}
+	return values, nil
+}
+
+// parseTypeFilters parses _typeFilter values like Observation?code=1234-5 into
+// search parameters per type. Several filters for a type are ORed.
+func parseTypeFilters(filterParams []string, resourceTypes []string) (map[string][]url.Values, error) {
+	var filters []string
+	for _, filterParam := range filterParams {
+		// Commas separate filters, but may also appear inside a filter query
+		for _, part := range strings.Split(filterParam, ",") {
+			if len(filters) > 0 && !strings.Contains(part, "?") {
+				filters[len(filters)-1] += "," + part
+				continue
+			}
+			filters = append(filters, part)
+		}
+	}
+
+	typeFilters := make(map[string][]url.Values)
+	for _, filter := range filters {
+		resourceType, query, found := strings.Cut(strings.TrimSpace(filter), "?")
+		if !found || resourceType == "" {
+			return nil, fmt.Errorf("invalid _typeFilter: %s", filter)
+		}
+		if !containsString(resourceTypes, resourceType) {
+			return nil, fmt.Errorf("_typeFilter type %s is not exported", resourceType)
+		}
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid _typeFilter: %s", filter)
+		}
+		typeFilters[resourceType] = append(typeFilters[resourceType], values)
+	}
+	return typeFilters, nil
+}
+
+// patientSearchParam returns the search parameter linking resourceType to a
+// patient, or "" if it has none
+func patientSearchParam(schemaDict map[string]gql.SchemaType, resourceType string) string {
+	param := ""
+	for _, field := range schemaDict[resourceType].Fields {
+		switch field.Name {
+		case "patient":
+			return "patient"
+		case "subject":
+			param = "subject"
+		}
+	}
+	return param
+}
+
+// patientCompartmentTypes approximates the Patient compartment with Patient
+// and the searchable types that have a patient or subject element
+func patientCompartmentTypes(schemaDict map[string]gql.SchemaType) []string {
+	var types []string
+	for _, resourceType := range searchableTypes(schemaDict) {
+		if resourceType == "Patient" || patientSearchParam(schemaDict, resourceType) != "" {
+			types = append(types, resourceType)
+		}
+	}
+	return types
+}
+
+// groupPatients returns the ids of the patients in a Group
+func groupPatients(req *http.Request, groupID string) ([]string, error) {
+	query := gql.Query{
+		Operation: "query",
+		Name:      "GetGroup",
+		Fields: []gql.Field{
+			{
+				Name:      "Group",
+				Arguments: gql.Arguments{"id": gql.ArgumentValue{Value: groupID}},
+				SubFields: []gql.Field{
+					{Name: "member", SubFields: []gql.Field{
+						{Name: "entity", SubFields: []gql.Field{{Name: "reference"}}},
+					}},
+				},
+			},
+		},
+	}
+
+	response, err := GqlRequest(query.String(), "", req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var result struct {
+		Data struct {
+			Group *struct {
+				Member []struct {
+					Entity struct {
+						Reference string `json:"reference"`
+					} `json:"entity"`
+				} `json:"member"`
+			} `json:"Group"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil || result.Data.Group == nil {
+		return nil, fmt.Errorf("Group/%s not found", groupID)
+	}
+
+	patients := []string{}
+	for _, member := range result.Data.Group.Member {
+		segments := strings.Split(member.Entity.Reference, "/")
+		if len(segments) >= 2 && segments[len(segments)-2] == "Patient" {
+			patients = appendUnique(patients, segments[len(segments)-1])
+		}
+	}
+	return patients, nil
+}
+
+func newJobID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// run exports each resource type in turn. Upstream errors for a type end up
+// in the error file, anything else fails the whole job.
+func (job *exportJob) run(req *http.Request) {
+	ctxLog := LoggerFromRequest(req).With("job", job.ID)
+
+	var err error
+	for _, resourceType := range job.Types {
+		if err = job.exportType(req, resourceType); err != nil {
+			break
+		}
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.deleted {
+		ctxLog.Info("Export cancelled")
+		os.RemoveAll(job.dir)
+		return
+	}
+	job.finishedAt = time.Now()
+	if err != nil {
+		ctxLog.Error("Export failed", "error", err)
+		job.status = EXPORT_FAILED
+		job.err = err
+		return
+	}
+	ctxLog.Info("Export completed", "files", len(job.output))
+	job.status = EXPORT_COMPLETED
+}
+
+func (job *exportJob) exportType(req *http.Request, resourceType string) error {
+	if job.Patients != nil && len(job.Patients) == 0 {
+		return nil
+	}
+
+	fileName := resourceType + ".ndjson"
+	file, err := os.Create(filepath.Join(job.dir, fileName))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+
+	filters := job.TypeFilters[resourceType]
+	if len(filters) == 0 {
+		filters = []url.Values{nil}
+	}
+	fragment := GenerateFragment(job.Tenant.Schema, resourceType)
+	seen := make(map[string]bool)
+	count := 0
+
+	for _, filter := range filters {
+		searchParams := job.searchParams(resourceType, filter)
+		cursor := ""
+		for {
+			nodes, next, err := fetchExportPage(req, resourceType, searchParams, cursor, fragment)
+			if err != nil {
+				if req.Context().Err() != nil {
+					return req.Context().Err()
+				}
+				if err := job.addError(resourceType, err); err != nil {
+					return err
+				}
+				break
+			}
+
+			for _, node := range nodes {
+				if id, _ := node["id"].(string); id != "" {
+					if seen[id] {
+						continue
+					}
+					seen[id] = true
+				}
+				removeEmpties(job.Tenant.Schema, node)
+				rewriteReferences(node, job.Tenant.UpstreamBase(), job.PublicBase)
+				line, err := json.Marshal(node)
+				if err != nil {
+					return err
+				}
+				if ordered, err := formatFhirJSON(line, job.Tenant.Schema, false); err == nil {
+					line = ordered
+				}
+				writer.Write(line)
+				writer.WriteByte('\n')
+				count++
+			}
+
+			job.mu.Lock()
+			job.progress = fmt.Sprintf("%s: %d resources", resourceType, count)
+			job.mu.Unlock()
+
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if count == 0 {
+		file.Close()
+		return os.Remove(file.Name())
+	}
+
+	job.mu.Lock()
+	job.output = append(job.output, exportOutput{
+		Type:  resourceType,
+		URL:   job.fileURL(fileName),
+		Count: count,
+	})
+	job.mu.Unlock()
+	return nil
+}
+
+// searchParams combines a _typeFilter with _since and the Group members
+func (job *exportJob) searchParams(resourceType string, filter url.Values) gql.Arguments {
+	searchParams := make(gql.Arguments)
+	for key, value := range filter {
+		if strings.HasPrefix(key, "_") && !containsString(commonSearchParams, key) {
+			continue
+		}
+		searchParams[key] = gql.ArgumentValue{Value: value[0]}
+	}
+	if job.Since != "" {
+		searchParams["_lastUpdated"] = gql.ArgumentValue{Value: "ge" + job.Since}
+	}
+	if job.Patients != nil {
+		if resourceType == "Patient" {
+			searchParams["_id"] = gql.ArgumentValue{Value: strings.Join(job.Patients, ",")}
+		} else {
+			references := make([]string, len(job.Patients))
+			for i, id := range job.Patients {
+				references[i] = "Patient/" + id
+			}
+			param := patientSearchParam(job.Tenant.Schema, resourceType)
+			searchParams[param] = gql.ArgumentValue{Value: strings.Join(references, ",")}
+		}
+	}
+	return searchParams
+}
+
+// addError appends an OperationOutcome to the job's error file
+func (job *exportJob) addError(resourceType string, exportErr error) error {
+	fileName := "OperationOutcome.ndjson"
+	file, err := os.OpenFile(filepath.Join(job.dir, fileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	diagnostics := exportErr.Error()
+	outcome := OperationOutcome("exception", "Failed to export "+resourceType, &diagnostics)
+	if _, err := file.Write(append(outcome, '\n')); err != nil {
+		return err
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if len(job.errors) == 0 {
+		job.errors = append(job.errors, exportOutput{Type: "OperationOutcome", URL: job.fileURL(fileName)})
+	}
+	job.errors[0].Count++
+	return nil
+}
+
+func (job *exportJob) fileURL(fileName string) string {
+	return job.PublicBase + EXPORT_FILE_PATH + "/" + job.ID + "/" + fileName
+}
+
+// fetchExportPage fetches one page of a connection and returns its nodes and
+// the cursor of the next page, if any
+func fetchExportPage(req *http.Request, resourceType string, searchParams gql.Arguments, cursor string, fragment gql.Fragment) ([]map[string]interface{}, string, error) {
+	arguments := gql.Arguments{
+		"first": gql.ArgumentValue{Value: strconv.Itoa(EXPORT_PAGE_SIZE), Literal: true},
+	}
+	if len(searchParams) > 0 {
+		arguments["search"] = gql.ArgumentValue{SubArguments: searchParams}
+	}
+	if cursor != "" {
+		arguments["after"] = gql.ArgumentValue{Value: cursor}
+	}
+
+	query := gql.Query{
+		Operation: "query",
+		Name:      "Export" + resourceType,
+		Fields: []gql.Field{
+			{
+				Name:       resourceType,
+				Alias:      resourceType,
+				Arguments:  arguments,
+				Fragments:  []gql.Fragment{fragment},
+				Connection: true,
+			},
+		},
+	}
+	gqlStr := fragment.String() + "\n" + query.String()
+
+	response, err := GqlRequest(gqlStr, "", req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var result struct {
+		Data map[string]*struct {
+			PageInfo struct {
+				HasNextPage bool   `json:"hasNextPage"`
+				EndCursor   string `json:"endCursor"`
+			} `json:"pageInfo"`
+			Edges []struct {
+				Node map[string]interface{} `json:"node"`
+			} `json:"edges"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, "", fmt.Errorf("upstream returned %d: %s", response.StatusCode, body)
+	}
+	if len(result.Errors) > 0 {
+		messages := make([]string, len(result.Errors))
+		for i, gqlErr := range result.Errors {
+			messages[i] = gqlErr.Message
+		}
+		return nil, "", fmt.Errorf("%s", strings.Join(messages, "; "))
+	}
+
+	connection := result.Data[resourceType]
+	if connection == nil {
+		return nil, "", fmt.Errorf("upstream returned no %s connection", resourceType)
+	}
+
+	nodes := make([]map[string]interface{}, 0, len(connection.Edges))
+	for _, edge := range connection.Edges {
+		if edge.Node != nil {
+			nodes = append(nodes, edge.Node)
+		}
+	}
+
+	next := ""
+	if connection.PageInfo.HasNextPage && connection.PageInfo.EndCursor != cursor {
+		next = connection.PageInfo.EndCursor
+	}
+	return nodes, next, nil
+}
+
+// lookupExportJob returns the export job with id if it belongs to the tenant
+// and the token subject of req
+func lookupExportJob(req *http.Request, id string) *exportJob {
+	exportJobsMu.Lock()
+	defer exportJobsMu.Unlock()
+	job, exists := exportJobs[id]
+	if !exists || job.Tenant != TenantFromRequest(req) || job.Owner != requestSubject(req) {
+		return nil
+	}
+	return job
+}
+
+// exportStatusHandler reports the progress of an export, or its manifest once
+// complete
+func exportStatusHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	job := lookupExportJob(req, params.ID)
+	if job == nil {
+		SendError(w, "Export job not found", http.StatusNotFound)
+		return
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	switch job.status {
+	case EXPORT_IN_PROGRESS:
+		if job.progress != "" {
+			w.Header().Set("X-Progress", job.progress)
+		}
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusAccepted)
+	case EXPORT_FAILED:
+		SendError(w, job.err.Error(), http.StatusInternalServerError)
+	default:
+		manifest := exportManifest{
+			TransactionTime:     job.TransactionTime.Format(time.RFC3339),
+			Request:             job.Request,
+			RequiresAccessToken: authEnabled(),
+			Output:              job.output,
+			Error:               job.errors,
+		}
+		if manifest.Output == nil {
+			manifest.Output = []exportOutput{}
+		}
+		if manifest.Error == nil {
+			manifest.Error = []exportOutput{}
+		}
+		body, err := json.Marshal(manifest)
+		if err != nil {
+			SendError(w, "Failed to create export manifest", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Expires", job.finishedAt.Add(EXPORT_EXPIRY).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
+
+// exportDeleteHandler cancels a running export or deletes the files of a
+// finished one
+func exportDeleteHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	job := lookupExportJob(req, params.ID)
+	if job == nil {
+		SendError(w, "Export job not found", http.StatusNotFound)
+		return
+	}
+	deleteExportJob(job)
+	LoggerFromRequest(req).Info("Export deleted", "job", job.ID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func deleteExportJob(job *exportJob) {
+	exportJobsMu.Lock()
+	delete(exportJobs, job.ID)
+	exportJobsMu.Unlock()
+
+	job.mu.Lock()
+	job.deleted = true
+	running := job.status == EXPORT_IN_PROGRESS
+	job.mu.Unlock()
+
+	// A running job removes its own files once it has stopped
+	job.cancel()
+	if !running {
+		os.RemoveAll(job.dir)
+	}
+}
+
+// exportFileHandler serves an NDJSON file of a completed export
+func exportFileHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	job := lookupExportJob(req, params.ID)
+	if job == nil {
+		SendError(w, "Export job not found", http.StatusNotFound)
+		return
+	}
+
+	job.mu.Lock()
+	fileURL := job.fileURL(params.File)
+	found := false
+	for _, output := range append(job.output, job.errors...) {
+		found = found || output.URL == fileURL
+	}
+	completed := job.status == EXPORT_COMPLETED
+	job.mu.Unlock()
+
+	if !completed || !found {
+		SendError(w, "Export file not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(job.dir, params.File))
+	if err != nil {
+		SendError(w, "Export file not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		SendError(w, "Export file not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", NDJSON_CONTENT_TYPE)
+	http.ServeContent(w, req, params.File, stat.ModTime(), file)
+}
+
+// expireExportJobs deletes finished exports once they are older than
+// EXPORT_EXPIRY
+func expireExportJobs() {
+	for range time.Tick(time.Minute) {
+		var expired []*exportJob
+		exportJobsMu.Lock()
+		for _, job := range exportJobs {
+			job.mu.Lock()
+			if job.status != EXPORT_IN_PROGRESS && time.Since(job.finishedAt) > EXPORT_EXPIRY {
+				expired = append(expired, job)
+			}
+			job.mu.Unlock()
+		}
+		exportJobsMu.Unlock()
+
+		for _, job := range expired {
+			log.Info("Export expired", "job", job.ID)
+			deleteExportJob(job)
+		}
+	}
+}
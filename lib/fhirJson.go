@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+// formatFhirJSON re-encodes a FHIR JSON resource with resourceType first and
+// the other elements in schema field order, so the output is stable. Pretty
+// output is indented.
+func formatFhirJSON(body []byte, schema map[string]gql.SchemaType, pretty bool) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var resource map[string]interface{}
+	if err := dec.Decode(&resource); err != nil {
+		return nil, err
+	}
+	if resourceType, _ := resource["resourceType"].(string); resourceType == "" {
+		return nil, fmt.Errorf("not a FHIR resource")
+	}
+
+	j := &fhirJSONWriter{schema: schema}
+	if err := j.writeResource(resource); err != nil {
+		return nil, err
+	}
+	if !pretty {
+		return j.buf.Bytes(), nil
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, j.buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	indented.WriteString("\n")
+	return indented.Bytes(), nil
+}
+
+type fhirJSONWriter struct {
+	schema map[string]gql.SchemaType
+	buf    bytes.Buffer
+}
+
+func (j *fhirJSONWriter) writeResource(resource map[string]interface{}) error {
+	resourceType, _ := resource["resourceType"].(string)
+	return j.writeObject(resource, resourceType, resourceType, true)
+}
+
+func (j *fhirJSONWriter) writeKey(name string, first bool) {
+	if !first {
+		j.buf.WriteByte(',')
+	}
+	key, _ := json.Marshal(name)
+	j.buf.Write(key)
+	j.buf.WriteByte(':')
+}
+
+func (j *fhirJSONWriter) writeObject(obj map[string]interface{}, typeName string, path string, isResource bool) error {
+	j.buf.WriteByte('{')
+	first := true
+	if resourceType, exists := obj["resourceType"]; exists {
+		j.writeKey("resourceType", true)
+		if err := j.writeValue(resourceType, "", path); err != nil {
+			return err
+		}
+		first = false
+	}
+
+	for _, name := range elementOrder(j.schema, obj, typeName, path, isResource) {
+		if name == "resourceType" {
+			continue
+		}
+		childType := builtinElementTypes[name]
+		if field, exists := schemaField(j.schema, typeName, name); exists {
+			childType = field.Type
+		}
+		childPath := path + "." + name
+
+		// A primitive's extensions follow the primitive itself
+		for _, key := range []string{name, "_" + name} {
+			value, exists := obj[key]
+			if !exists {
+				continue
+			}
+			j.writeKey(key, first)
+			first = false
+			if key != name {
+				childType = ""
+			}
+			if err := j.writeValue(value, childType, childPath); err != nil {
+				return err
+			}
+		}
+	}
+	j.buf.WriteByte('}')
+	return nil
+}
+
+func (j *fhirJSONWriter) writeValue(value interface{}, typeName string, path string) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if resourceType, _ := v["resourceType"].(string); resourceType != "" {
+			return j.writeResource(v)
+		}
+		return j.writeObject(v, typeName, path, false)
+	case []interface{}:
+		j.buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				j.buf.WriteByte(',')
+			}
+			if err := j.writeValue(item, typeName, path); err != nil {
+				return err
+			}
+		}
+		j.buf.WriteByte(']')
+		return nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	j.buf.Write(encoded)
+	return nil
+}
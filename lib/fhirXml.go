@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+// Conversion between the FHIR JSON and XML representations, see
+// https://hl7.org/fhir/xml.html and https://hl7.org/fhir/json.html
+
+const (
+	FHIR_NAMESPACE  = "http://hl7.org/fhir"
+	XHTML_NAMESPACE = "http://www.w3.org/1999/xhtml"
+)
+
+// Element order for the resources fhirrtg builds itself, used when the
+// upstream schema does not describe them
+var builtinElementOrder = map[string][]string{
+	"Bundle":                         {"id", "meta", "implicitRules", "language", "identifier", "type", "timestamp", "total", "link", "entry", "signature"},
+	"Bundle.link":                    {"relation", "url"},
+	"Bundle.entry":                   {"link", "fullUrl", "resource", "search", "request", "response"},
+	"Bundle.entry.search":            {"mode", "score"},
+	"Bundle.entry.request":           {"method", "url", "ifNoneMatch", "ifModifiedSince", "ifMatch", "ifNoneExist"},
+	"Bundle.entry.response":          {"status", "location", "etag", "lastModified", "outcome"},
+	"OperationOutcome":               {"id", "meta", "implicitRules", "language", "text", "contained", "extension", "modifierExtension", "issue"},
+	"OperationOutcome.issue":         {"extension", "severity", "code", "details", "diagnostics", "location", "expression"},
+	"OperationOutcome.issue.details": {"coding", "text"},
+	"Extension":                      {"extension", "url"},
+	"Narrative":                      {"extension", "status", "div"},
+}
+
+// Elements every resource starts with, in order
+var resourceBaseElements = []string{"id", "meta", "implicitRules", "language", "text", "contained", "extension", "modifierExtension"}
+
+// Elements every other element starts with, in order
+var elementBaseElements = []string{"id", "extension", "modifierExtension"}
+
+// Types of common elements, used when the schema does not describe them
+var builtinElementTypes = map[string]string{
+	"extension":         "Extension",
+	"modifierExtension": "Extension",
+	"text":              "Narrative",
+}
+
+// Elements that are always lists
+var listElements = map[string]bool{
+	"extension":         true,
+	"modifierExtension": true,
+	"contained":         true,
+}
+
+// Primitive scalar types whose JSON representation is not a string
+var (
+	booleanScalars = map[string]bool{"Boolean": true, "boolean": true}
+	numberScalars  = map[string]bool{"Int": true, "Float": true, "integer": true, "integer64": true, "decimal": true, "positiveInt": true, "unsignedInt": true}
+)
+
+func schemaField(schema map[string]gql.SchemaType, typeName string, name string) (gql.Field, bool) {
+	for _, field := range schema[typeName].Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return gql.Field{}, false
+}
+
+func isResourceName(name string) bool {
+	return name != "" && unicode.IsUpper(rune(name[0]))
+}
+
+type fhirXMLWriter struct {
+	schema map[string]gql.SchemaType
+	buf    bytes.Buffer
+}
+
+// fhirJSONToXML converts a FHIR JSON resource to FHIR XML, ordering elements
+// by the field order of the schema
+func fhirJSONToXML(body []byte, schema map[string]gql.SchemaType) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var resource map[string]interface{}
+	if err := dec.Decode(&resource); err != nil {
+		return nil, err
+	}
+	if resourceType, _ := resource["resourceType"].(string); resourceType == "" {
+		return nil, fmt.Errorf("not a FHIR resource")
+	}
+
+	x := &fhirXMLWriter{schema: schema}
+	x.buf.WriteString(xml.Header)
+	x.writeResource(resource, true)
+	return x.buf.Bytes(), nil
+}
+
+func (x *fhirXMLWriter) attr(name string, value string) {
+	x.buf.WriteString(" " + name + `="`)
+	xml.EscapeText(&x.buf, []byte(value))
+	x.buf.WriteString(`"`)
+}
+
+func (x *fhirXMLWriter) writeResource(resource map[string]interface{}, namespace bool) {
+	resourceType, _ := resource["resourceType"].(string)
+	x.buf.WriteString("<" + resourceType)
+	if namespace {
+		x.attr("xmlns", FHIR_NAMESPACE)
+	}
+	x.buf.WriteString(">")
+	x.writeChildren(resource, resourceType, resourceType, true)
+	x.buf.WriteString("</" + resourceType + ">")
+}
+
+// elementOrder returns the element names of obj in FHIR definition order.
+// Primitive extensions ("_name") are folded into their element.
+func elementOrder(schema map[string]gql.SchemaType, obj map[string]interface{}, typeName string, path string, isResource bool) []string {
+	present := make(map[string]bool)
+	for key := range obj {
+		present[strings.TrimPrefix(key, "_")] = true
+	}
+
+	var order []string
+	if isResource {
+		order = append(order, resourceBaseElements...)
+	} else {
+		order = append(order, elementBaseElements...)
+	}
+	if schemaType, exists := schema[typeName]; exists && len(schemaType.Fields) > 0 {
+		for _, field := range schemaType.Fields {
+			order = append(order, field.Name)
+		}
+	} else if builtin, exists := builtinElementOrder[path]; exists {
+		order = append(order, builtin...)
+	} else {
+		order = append(order, builtinElementOrder[typeName]...)
+	}
+
+	var names []string
+	for _, name := range order {
+		if present[name] {
+			names = append(names, name)
+			delete(present, name)
+		}
+	}
+
+	// Anything the schema does not know about goes last in a stable order
+	var rest []string
+	for name := range present {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+func (x *fhirXMLWriter) writeChildren(obj map[string]interface{}, typeName string, path string, isResource bool) {
+	isExtension := strings.HasSuffix(path, "xtension")
+	for _, name := range elementOrder(x.schema, obj, typeName, path, isResource) {
+		if name == "resourceType" {
+			continue
+		}
+		// Element ids and extension urls are attributes
+		if !isResource && name == "id" {
+			continue
+		}
+		if isExtension && name == "url" {
+			continue
+		}
+
+		childType := builtinElementTypes[name]
+		if field, exists := schemaField(x.schema, typeName, name); exists {
+			childType = field.Type
+		}
+		childPath := path + "." + name
+
+		value := obj[name]
+		ext := obj["_"+name]
+		if values, ok := value.([]interface{}); ok {
+			exts, _ := ext.([]interface{})
+			for i, item := range values {
+				var itemExt interface{}
+				if i < len(exts) {
+					itemExt = exts[i]
+				}
+				x.writeElement(name, item, itemExt, childType, childPath)
+			}
+			continue
+		}
+		if value == nil {
+			// Primitive with only an id or extensions
+			if exts, ok := ext.([]interface{}); ok {
+				for _, itemExt := range exts {
+					x.writeElement(name, nil, itemExt, childType, childPath)
+				}
+				continue
+			}
+		}
+		x.writeElement(name, value, ext, childType, childPath)
+	}
+}
+
+func (x *fhirXMLWriter) writeElement(name string, value interface{}, ext interface{}, typeName string, path string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if resourceType, _ := v["resourceType"].(string); resourceType != "" {
+			x.buf.WriteString("<" + name + ">")
+			x.writeResource(v, false)
+			x.buf.WriteString("</" + name + ">")
+			return
+		}
+		x.buf.WriteString("<" + name)
+		if id, ok := v["id"].(string); ok {
+			x.attr("id", id)
+		}
+		if url, ok := v["url"].(string); ok && (name == "extension" || name == "modifierExtension") {
+			x.attr("url", url)
+		}
+		x.buf.WriteString(">")
+		x.writeChildren(v, typeName, path, false)
+		x.buf.WriteString("</" + name + ">")
+		return
+
+	case string:
+		if name == "div" && x.writeXHTML(v) {
+			return
+		}
+	}
+
+	extMap, _ := ext.(map[string]interface{})
+	if value == nil && extMap == nil {
+		return
+	}
+
+	x.buf.WriteString("<" + name)
+	if id, ok := extMap["id"].(string); ok {
+		x.attr("id", id)
+	}
+	if value != nil {
+		x.attr("value", fmt.Sprint(value))
+	}
+	if extensions, ok := extMap["extension"].([]interface{}); ok && len(extensions) > 0 {
+		x.buf.WriteString(">")
+		for _, extension := range extensions {
+			x.writeElement("extension", extension, nil, "Extension", "Extension")
+		}
+		x.buf.WriteString("</" + name + ">")
+		return
+	}
+	x.buf.WriteString("/>")
+}
+
+// writeXHTML embeds narrative XHTML as-is if it is well-formed
+func (x *fhirXMLWriter) writeXHTML(div string) bool {
+	dec := xml.NewDecoder(strings.NewReader(div))
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false
+		}
+	}
+	x.buf.WriteString(div)
+	return true
+}
+
+type fhirXMLReader struct {
+	schema map[string]gql.SchemaType
+	dec    *xml.Decoder
+	body   []byte
+}
+
+// fhirXMLToJSON converts a FHIR XML resource to FHIR JSON, using the schema
+// to decide which elements are lists and how primitives are typed
+func fhirXMLToJSON(body []byte, schema map[string]gql.SchemaType) ([]byte, error) {
+	r := &fhirXMLReader{schema: schema, dec: xml.NewDecoder(bytes.NewReader(body)), body: body}
+	for {
+		tok, err := r.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Space != FHIR_NAMESPACE {
+				return nil, fmt.Errorf("root element %s is not in the FHIR namespace", start.Name.Local)
+			}
+			resource, err := r.readResource(start)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(resource)
+		}
+	}
+}
+
+func (r *fhirXMLReader) readResource(start xml.StartElement) (map[string]interface{}, error) {
+	obj, _, err := r.readChildren(start.Name.Local)
+	if err != nil {
+		return nil, err
+	}
+	resource := map[string]interface{}{"resourceType": start.Name.Local}
+	for key, value := range obj {
+		resource[key] = value
+	}
+	return resource, nil
+}
+
+type xmlElementValue struct {
+	value interface{}
+	ext   map[string]interface{}
+}
+
+// readChildren reads child elements up to the end of the current element. If
+// the first child is a resource (as in Bundle.entry.resource) that resource
+// is returned instead.
+func (r *fhirXMLReader) readChildren(typeName string) (map[string]interface{}, map[string]interface{}, error) {
+	values := make(map[string][]xmlElementValue)
+	var names []string
+
+	for {
+		offset := r.dec.InputOffset()
+		tok, err := r.dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.EndElement:
+			return r.collect(typeName, names, values), nil, nil
+
+		case xml.StartElement:
+			name := t.Name.Local
+			if isResourceName(name) {
+				resource, err := r.readResource(t)
+				if err != nil {
+					return nil, nil, err
+				}
+				if err := r.dec.Skip(); err != nil {
+					return nil, nil, err
+				}
+				return nil, resource, nil
+			}
+
+			if name == "div" && t.Name.Space == XHTML_NAMESPACE {
+				if err := r.dec.Skip(); err != nil {
+					return nil, nil, err
+				}
+				div := strings.TrimSpace(string(r.body[offset:r.dec.InputOffset()]))
+				values[name] = append(values[name], xmlElementValue{value: div})
+				names = appendUnique(names, name)
+				continue
+			}
+
+			element, err := r.readElement(t, typeName)
+			if err != nil {
+				return nil, nil, err
+			}
+			values[name] = append(values[name], element)
+			names = appendUnique(names, name)
+		}
+	}
+}
+
+func (r *fhirXMLReader) readElement(start xml.StartElement, parentType string) (xmlElementValue, error) {
+	attrs := make(map[string]string)
+	for _, attr := range start.Attr {
+		attrs[attr.Name.Local] = attr.Value
+	}
+
+	field, known := schemaField(r.schema, parentType, start.Name.Local)
+	childType := field.Type
+	if !known {
+		childType = builtinElementTypes[start.Name.Local]
+	}
+
+	rawValue, hasValue := attrs["value"]
+	isPrimitive := hasValue || (known && (field.Kind == "SCALAR" || field.Kind == "ENUM"))
+
+	obj, resource, err := r.readChildren(childType)
+	if err != nil {
+		return xmlElementValue{}, err
+	}
+	if resource != nil {
+		return xmlElementValue{value: resource}, nil
+	}
+
+	if isPrimitive {
+		element := xmlElementValue{}
+		if hasValue {
+			element.value = typedPrimitive(rawValue, field.Type)
+		}
+		if id, ok := attrs["id"]; ok {
+			obj["id"] = id
+		}
+		if len(obj) > 0 {
+			element.ext = obj
+		}
+		return element, nil
+	}
+
+	if id, ok := attrs["id"]; ok {
+		obj["id"] = id
+	}
+	if url, ok := attrs["url"]; ok {
+		obj["url"] = url
+	}
+	return xmlElementValue{value: obj}, nil
+}
+
+func typedPrimitive(value string, typeName string) interface{} {
+	switch {
+	case booleanScalars[typeName]:
+		return value == "true"
+	case numberScalars[typeName]:
+		return json.Number(value)
+	}
+	return value
+}
+
+// collect turns the elements read for an object into JSON properties
+func (r *fhirXMLReader) collect(typeName string, names []string, values map[string][]xmlElementValue) map[string]interface{} {
+	obj := make(map[string]interface{})
+	for _, name := range names {
+		elements := values[name]
+		field, _ := schemaField(r.schema, typeName, name)
+		isList := field.List || len(elements) > 1 || listElements[name]
+
+		hasExt := false
+		for _, element := range elements {
+			if element.ext != nil {
+				hasExt = true
+			}
+		}
+
+		if !isList {
+			if elements[0].value != nil {
+				obj[name] = elements[0].value
+			}
+			if hasExt {
+				obj["_"+name] = elements[0].ext
+			}
+			continue
+		}
+
+		list := make([]interface{}, len(elements))
+		exts := make([]interface{}, len(elements))
+		hasValue := false
+		for i, element := range elements {
+			if element.value != nil {
+				list[i] = element.value
+				hasValue = true
+			}
+			if element.ext != nil {
+				exts[i] = element.ext
+			}
+		}
+		if hasValue {
+			obj[name] = list
+		}
+		if hasExt {
+			obj["_"+name] = exts
+		}
+	}
+	return obj
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
-	"os"
 	"strings"
 
 	"github.com/fhirrtg/fhirrtg/gql"
@@ -15,10 +15,6 @@ const (
 	GQL_DEPTH_LIMIT = 3
 )
 
-var (
-	schemaDict map[string]gql.SchemaType
-)
-
 type IntrospectionResponse struct {
 	Data IntrospectionData `json:"data"`
 }
@@ -68,8 +64,8 @@ func ofTypeIntrospection(depth int, cur int) gql.Field {
 	return field
 }
 
-func introspect() error {
-	query := gql.Query{
+func introspectionQuery() gql.Query {
+	return gql.Query{
 		Fields: []gql.Field{
 			{Name: "__schema",
 				SubFields: []gql.Field{
@@ -105,28 +101,38 @@ func introspect() error {
 			},
 		},
 	}
+}
 
-	if LOG_LEVEL < 0 {
-		fmt.Println("Introspection Query:")
-		fmt.Println(query.String())
-	}
+// fetchIntrospection runs the introspection query against the tenant's upstream
+// server and returns the raw response body
+func fetchIntrospection(tenant *Tenant) ([]byte, error) {
+	query := introspectionQuery()
 
-	resp, err := GqlRequest(query.String(), "", nil)
+	resp, err := GqlRequestTo(tenant, query.String(), "", nil)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\n%s\n", string(err.Error()))
-		return err
+		log.Error("Introspection request failed", "tenant", tenant.String(), "error", err)
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\n%s\n", string(err.Error()))
-		return err
+		log.Error("Failed to read introspection response", "tenant", tenant.String(), "error", err)
+		return nil, err
 	}
 
 	if resp.StatusCode >= 400 {
-		fmt.Fprintf(os.Stderr, "\n%s\n", string(body))
-		return fmt.Errorf("introspection query failed: %s %s: %s", resp.Status, "response", string(body))
+		log.Error("Introspection query failed", "tenant", tenant.String(), "status", resp.StatusCode, "body", string(body))
+		return nil, fmt.Errorf("introspection query failed: %s %s: %s", resp.Status, "response", string(body))
+	}
+
+	return body, nil
+}
+
+func introspect(tenant *Tenant) error {
+	body, err := fetchIntrospection(tenant)
+	if err != nil {
+		return err
 	}
 
 	fd, err := buildFieldDict(body)
@@ -134,13 +140,25 @@ func introspect() error {
 		return err
 	}
 
+	if err := checkFieldDict(fd); err != nil {
+		return err
+	}
+	tenant.Schema = fd
+	return nil
+}
+
+// checkFieldDict verifies a freshly built field dictionary and dumps it in debug mode
+func checkFieldDict(fd map[string]gql.SchemaType) error {
 	if len(fd) == 0 {
-		fmt.Fprintf(os.Stderr, "\nEmpty field dictionary\n")
+		log.Error("Empty field dictionary")
 		return fmt.Errorf("Empty field dictionary")
 	}
+	if !log.Enabled(context.Background(), slog.LevelDebug) {
+		return nil
+	}
 
-	// Print the field dictionary
-	debugStr := "Field Dictionary:"
+	// Log the field dictionary
+	debugStr := ""
 
 	for key, value := range fd {
 		debugStr += fmt.Sprintf("%s [%s]\n", key, value.Kind)
@@ -155,10 +173,7 @@ func introspect() error {
 			debugStr += fmt.Sprintf("   %s (%s|%s)\n", field.Name, field.Type, field.Kind)
 		}
 	}
-	if LOG_LEVEL < 0 {
-		fmt.Println(debugStr)
-	}
-
+	log.Debug("Field dictionary", "types", debugStr)
 	return nil
 }
 
@@ -170,9 +185,13 @@ func buildFieldDict(response []byte) (map[string]gql.SchemaType, error) {
 		return nil, err
 	}
 
-	schemaDict = make(map[string]gql.SchemaType)
+	return buildFieldDictFromTypes(introspection.Data.Schema.Types), nil
+}
+
+func buildFieldDictFromTypes(types []IntrospectionType) map[string]gql.SchemaType {
+	schemaDict := make(map[string]gql.SchemaType)
 
-	for _, typ := range introspection.Data.Schema.Types {
+	for _, typ := range types {
 		if strings.HasPrefix(typ.Name, "__") {
 			continue
 		}
@@ -187,6 +206,7 @@ func buildFieldDict(response []byte) (map[string]gql.SchemaType, error) {
 					Name: field.Name,
 					Type: fieldType,
 					Kind: fieldKind,
+					List: isListType(field.Type),
 				})
 			}
 		}
@@ -198,7 +218,7 @@ func buildFieldDict(response []byte) (map[string]gql.SchemaType, error) {
 		}
 	}
 
-	return schemaDict, nil
+	return schemaDict
 }
 
 func getFieldType(typeDef IntrospectionFieldTypeDef) (string, string) {
@@ -214,6 +234,16 @@ func getFieldType(typeDef IntrospectionFieldTypeDef) (string, string) {
 	return getFieldType(*typeDef.OfType)
 }
 
+func isListType(typeDef IntrospectionFieldTypeDef) bool {
+	if typeDef.Kind == "LIST" {
+		return true
+	}
+	if typeDef.OfType == nil {
+		return false
+	}
+	return isListType(*typeDef.OfType)
+}
+
 func convertPossibleTypes(possibleTypes []IntrospectionPossibleType) []gql.PossibleType {
 	var gqlPossibleTypes []gql.PossibleType
 	for _, pt := range possibleTypes {
@@ -225,7 +255,7 @@ func convertPossibleTypes(possibleTypes []IntrospectionPossibleType) []gql.Possi
 	return gqlPossibleTypes
 }
 
-func buildFieldTree(fields []gql.Field, level int) []gql.Field {
+func buildFieldTree(schemaDict map[string]gql.SchemaType, fields []gql.Field, level int) []gql.Field {
 	outFields := []gql.Field{}
 	for _, field := range fields {
 		outField := gql.Field{
@@ -235,7 +265,7 @@ func buildFieldTree(fields []gql.Field, level int) []gql.Field {
 		}
 		if field.Kind == "OBJECT" && level < GQL_DEPTH_LIMIT {
 			schema := schemaDict[field.Type]
-			outField.SubFields = buildFieldTree(schema.Fields, level+1)
+			outField.SubFields = buildFieldTree(schemaDict, schema.Fields, level+1)
 			outFields = append(outFields, outField)
 		}
 		if field.Kind == "SCALAR" || field.Kind == "ENUM" || field.Kind == "LIST" {
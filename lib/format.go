@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+const (
+	FORMAT_JSON = "json"
+	FORMAT_XML  = "xml"
+
+	FHIR_JSON_CONTENT_TYPE = "application/fhir+json; charset=utf-8"
+	FHIR_XML_CONTENT_TYPE  = "application/fhir+xml; charset=utf-8"
+)
+
+var formatMimeTypes = map[string]string{
+	"json":                  FORMAT_JSON,
+	"application/json":      FORMAT_JSON,
+	"application/fhir+json": FORMAT_JSON,
+	"application/json+fhir": FORMAT_JSON,
+	"xml":                   FORMAT_XML,
+	"text/xml":              FORMAT_XML,
+	"application/xml":       FORMAT_XML,
+	"application/fhir+xml":  FORMAT_XML,
+	"application/xml+fhir":  FORMAT_XML,
+}
+
+// formatWriter carries the negotiated response format down to the Send*
+// functions
+type formatWriter struct {
+	http.ResponseWriter
+	format string
+	pretty bool
+	schema map[string]gql.SchemaType
+	audit  *auditCapture
+}
+
+func (f *formatWriter) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+// negotiateFormat picks the response format from _format, then Accept,
+// defaulting to JSON
+func negotiateFormat(req *http.Request) (string, error) {
+	if formatParam := req.URL.Query().Get("_format"); formatParam != "" {
+		// An unescaped "+" in the query decodes as a space
+		mediaType := strings.ToLower(strings.ReplaceAll(formatParam, " ", "+"))
+		mediaType, _, _ = strings.Cut(mediaType, ";")
+		if format, ok := formatMimeTypes[strings.TrimSpace(mediaType)]; ok {
+			return format, nil
+		}
+		return "", fmt.Errorf("unsupported _format: %s", formatParam)
+	}
+
+	type acceptRange struct {
+		mediaType string
+		quality   float64
+	}
+	var ranges []acceptRange
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+		ranges = append(ranges, acceptRange{mediaType, quality})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].quality > ranges[j].quality })
+
+	for _, r := range ranges {
+		if r.quality <= 0 {
+			continue
+		}
+		if format, ok := formatMimeTypes[r.mediaType]; ok {
+			return format, nil
+		}
+		if r.mediaType == "*/*" || r.mediaType == "application/*" {
+			return FORMAT_JSON, nil
+		}
+	}
+	return FORMAT_JSON, nil
+}
+
+// prettyRequested reports whether the client asked for indented output
+func prettyRequested(req *http.Request) bool {
+	return strings.EqualFold(req.URL.Query().Get("_pretty"), "true")
+}
+
+// isXMLContentType reports whether a request body is FHIR XML
+func isXMLContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return formatMimeTypes[mediaType] == FORMAT_XML
+}
+
+// writeFhir writes a FHIR JSON resource in the negotiated format
+func writeFhir(w http.ResponseWriter, statusCode int, body []byte) {
+	fw, _ := w.(*formatWriter)
+	if fw == nil {
+		fw = &formatWriter{format: FORMAT_JSON}
+	}
+	if fw.audit != nil {
+		fw.audit.body = body
+	}
+
+	if fw.format == FORMAT_XML {
+		xmlBody, err := fhirJSONToXML(body, fw.schema)
+		if err == nil {
+			w.Header().Set("Content-Type", FHIR_XML_CONTENT_TYPE)
+			w.WriteHeader(statusCode)
+			w.Write(xmlBody)
+			return
+		}
+		log.Error("Failed to convert response to XML", "error", err)
+	}
+
+	if ordered, err := formatFhirJSON(body, fw.schema, fw.pretty); err == nil {
+		body = ordered
+	} else {
+		log.Debug("Response is not a FHIR resource, writing it as is", "error", err)
+	}
+
+	w.Header().Set("Content-Type", FHIR_JSON_CONTENT_TYPE)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
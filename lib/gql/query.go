@@ -36,6 +36,7 @@ func (v Variable) String() string {
 
 type ArgumentValue struct {
 	Value        string
+	Literal      bool // write Value unquoted, e.g. an Int or enum
 	SubArguments map[string]ArgumentValue
 }
 type Arguments map[string]ArgumentValue
@@ -51,6 +52,9 @@ func (a ArgumentValue) String() string {
 	if a.Value == "" {
 		return "{}"
 	}
+	if a.Literal {
+		return a.Value
+	}
 	return fmt.Sprintf("%q", a.Value)
 }
 
@@ -62,6 +66,7 @@ type Field struct {
 	Arguments  Arguments
 	Type       string
 	Kind       string
+	List       bool // schema fields only: the field holds a list of Type
 	Connection bool
 	Fragments  []Fragment
 }
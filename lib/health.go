@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+// Query that checks the upstream answers GraphQL without touching data
+const UPSTREAM_PING_QUERY = "{ __typename }"
+
+const (
+	HEALTH_PASS = "pass"
+	HEALTH_FAIL = "fail"
+)
+
+var startedAt = time.Now()
+
+// tenantHealth is the readiness of one tenant
+type tenantHealth struct {
+	Status      string `json:"status"`
+	Upstream    string `json:"upstream"`
+	SchemaTypes int    `json:"schemaTypes"`
+	SchemaHash  string `json:"schemaHash,omitempty"`
+	LatencyMs   int64  `json:"latencyMs"`
+	Error       string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Status        string                  `json:"status"`
+	Version       string                  `json:"version"`
+	UptimeSeconds int64                   `json:"uptimeSeconds"`
+	Tenants       map[string]tenantHealth `json:"tenants"`
+}
+
+// schemaHash identifies a schema, so replicas can be compared
+func schemaHash(schema map[string]gql.SchemaType) string {
+	// Maps are marshalled with sorted keys
+	content, err := json.Marshal(schema)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// pingUpstream sends a minimal GraphQL query to the upstream of tenant
+func pingUpstream(req *http.Request, tenant *Tenant) error {
+	ctx, cancel := context.WithTimeout(req.Context(), READINESS_TIMEOUT)
+	defer cancel()
+	// The probe's own headers are not forwarded
+	probe := req.Clone(ctx)
+	probe.Header = http.Header{}
+
+	resp, err := GqlRequestTo(tenant, UPSTREAM_PING_QUERY, "", probe)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Errors []graphQLError `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("upstream returned invalid JSON")
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("upstream returned an error: %s", result.Errors[0].Message)
+	}
+	return nil
+}
+
+func checkTenant(req *http.Request, tenant *Tenant) tenantHealth {
+	schema, hash := tenant.currentSchema()
+	health := tenantHealth{
+		Status:      HEALTH_PASS,
+		Upstream:    tenant.Upstream,
+		SchemaTypes: len(schema),
+		SchemaHash:  hash,
+	}
+	if len(schema) == 0 {
+		health.Status = HEALTH_FAIL
+		health.Error = "schema not loaded"
+		return health
+	}
+
+	start := time.Now()
+	err := pingUpstream(req, tenant)
+	health.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		health.Status = HEALTH_FAIL
+		health.Error = err.Error()
+	}
+	return health
+}
+
+// livenessHandler reports that the process is serving requests
+func livenessHandler(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// readinessHandler checks that every tenant has a schema and that its
+// upstream answers within READINESS_TIMEOUT. It fails with 503 otherwise.
+func readinessHandler(w http.ResponseWriter, req *http.Request) {
+	result := readiness{
+		Status:        HEALTH_PASS,
+		Version:       VERSION,
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+		Tenants:       make(map[string]tenantHealth),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, tenant := range allTenants() {
+		wg.Add(1)
+		go func(tenant *Tenant) {
+			defer wg.Done()
+			health := checkTenant(req, tenant)
+			mu.Lock()
+			defer mu.Unlock()
+			result.Tenants[tenantLabel(tenant)] = health
+			if health.Status != HEALTH_PASS {
+				result.Status = HEALTH_FAIL
+			}
+		}(tenant)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if result.Status != HEALTH_PASS {
+		status = http.StatusServiceUnavailable
+		LoggerFromRequest(req).Warn("Not ready", "tenants", result.Tenants)
+	}
+	body, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+
+	// Replaces redacted values in logs
+	REDACTED = "***"
+)
+
+// Search parameters and resource elements redacted by default: patient
+// demographics and identifiers
+const (
+	DEFAULT_REDACT_PARAMS   = "name,given,family,phonetic,birthdate,identifier,telecom,phone,email,address,address-city,address-postalcode,address-state"
+	DEFAULT_REDACT_ELEMENTS = "name,birthDate,identifier,telecom,address,photo,contact"
+)
+
+// parseLogLevel reads a level name: debug, info, warn or error
+func parseLogLevel(value string) (slog.Level, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return slog.LevelDebug, true
+	case "info":
+		return slog.LevelInfo, true
+	case "warn":
+		return slog.LevelWarn, true
+	case "error":
+		return slog.LevelError, true
+	}
+	return slog.LevelInfo, false
+}
+
+// parseNameList reads a comma separated list of names
+func parseNameList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = appendUnique(names, name)
+		}
+	}
+	return names
+}
+
+// newLogHandler returns a handler in LOG_FORMAT that redacts the attributes
+// carrying patient data
+func newLogHandler(level slog.Leveler) slog.Handler {
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	if LOG_FORMAT == LOG_FORMAT_JSON {
+		return slog.NewJSONHandler(os.Stdout, options)
+	}
+	return slog.NewTextHandler(os.Stdout, options)
+}
+
+// requestLogLevel returns the level requested in the RTG_LOG_LEVEL_HEADER
+// header of req, if the header is enabled and valid
+func requestLogLevel(req *http.Request) (slog.Level, bool) {
+	if LOG_LEVEL_HEADER == "" {
+		return 0, false
+	}
+	value := req.Header.Get(LOG_LEVEL_HEADER)
+	if value == "" {
+		return 0, false
+	}
+	return parseLogLevel(value)
+}
+
+// requestLogger returns the base logger of a request, with the level of the
+// log level header if there is one
+func requestLogger(req *http.Request) *slog.Logger {
+	if level, ok := requestLogLevel(req); ok {
+		return slog.New(newLogHandler(level))
+	}
+	return slog.Default()
+}
+
+// redactAttr masks patient data in the attributes that can carry it: the
+// query string, GraphQL queries and FHIR JSON bodies
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindString {
+		return a
+	}
+	switch a.Key {
+	case "query":
+		return slog.String(a.Key, redactQuery(a.Value.String()))
+	case "graphql":
+		return slog.String(a.Key, redactGraphQL(a.Value.String()))
+	case "body":
+		return slog.String(a.Key, redactJSON(a.Value.String()))
+	}
+	return a
+}
+
+// redactedParam reports whether a search parameter is redacted. Modifiers
+// and chains are ignored, so name:exact and subject.name match name.
+func redactedParam(name string) bool {
+	name, _, _ = strings.Cut(name, ":")
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.ReplaceAll(name, "_", "-")
+	for _, param := range REDACT_PARAMS {
+		if strings.EqualFold(param, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactedElement(name string) bool {
+	return containsString(REDACT_ELEMENTS, name)
+}
+
+// redactQuery masks the values of redacted search parameters in a raw query
+// string, keeping the order of the parameters
+func redactQuery(rawQuery string) string {
+	if rawQuery == "" || len(REDACT_PARAMS) == 0 {
+		return rawQuery
+	}
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(key)
+		if err != nil {
+			name = key
+		}
+		if redactedParam(name) {
+			pairs[i] = key + "=" + REDACTED
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// redactValue masks redacted elements of decoded FHIR JSON
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, element := range v {
+			if redactedElement(key) {
+				v[key] = REDACTED
+			} else {
+				v[key] = redactValue(element)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = redactValue(element)
+		}
+	}
+	return value
+}
+
+// redactJSON masks redacted elements of a FHIR JSON body. Bodies that are
+// not JSON are replaced entirely.
+func redactJSON(body string) string {
+	if body == "" || len(REDACT_ELEMENTS) == 0 {
+		return body
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(body), &value); err != nil {
+		return fmt.Sprintf("%s (%d bytes)", REDACTED, len(body))
+	}
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return REDACTED
+	}
+	return string(redacted)
+}
+
+// GraphQL string arguments: a name, which may have a search modifier, and a
+// quoted value
+var graphQLStringArgument = regexp.MustCompile(`([A-Za-z_][\w.-]*(?::[\w.-]+)*)(\s*:\s*)("(?:[^"\\]|\\.)*")`)
+
+// redactGraphQL masks the arguments for redacted search parameters and the
+// redacted elements of resources passed as JSON string arguments
+func redactGraphQL(query string) string {
+	if len(REDACT_PARAMS) == 0 && len(REDACT_ELEMENTS) == 0 {
+		return query
+	}
+	return graphQLStringArgument.ReplaceAllStringFunc(query, func(argument string) string {
+		parts := graphQLStringArgument.FindStringSubmatch(argument)
+		name, separator, quoted := parts[1], parts[2], parts[3]
+		if redactedParam(name) || redactedElement(name) {
+			return name + separator + strconv.Quote(REDACTED)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil || !strings.HasPrefix(strings.TrimSpace(value), "{") {
+			return argument
+		}
+		return name + separator + strconv.Quote(redactJSON(value))
+	})
+}
@@ -7,9 +7,13 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -22,42 +26,90 @@ const (
 	VERSION                   = "0.1"
 	DEFAULT_PORT              = 8888
 	DEFAULT_GQL_ACCEPT_HEADER = "application/graphql-response+json;charset=utf-8, application/json;charset=utf-8"
+
+	// Introspection retries start after STARTUP_BACKOFF_INITIAL and double up
+	// to STARTUP_BACKOFF_MAX
+	STARTUP_BACKOFF_INITIAL = time.Second
+	STARTUP_BACKOFF_MAX     = time.Minute
 )
 
 var (
-	HEALTHCHECK_PATH   = "/health"
-	PORT               int
-	GQL_ACCEPT_HEADER  string
-	LOG_LEVEL          slog.Level
-	MAX_STARTUP_WAIT_S = 60 // seconds
+	HEALTHCHECK_PATH      = "/health"
+	METRICS_PATH          = "/metrics"
+	READINESS_PATH        = "/ready"
+	READINESS_TIMEOUT     = 2 * time.Second
+	PORT                  int
+	GQL_ACCEPT_HEADER     string
+	LOG_LEVEL             slog.Level
+	LOG_FORMAT            string
+	LOG_LEVEL_HEADER      string
+	REDACT_PARAMS         []string
+	REDACT_ELEMENTS       []string
+	MAX_STARTUP_WAIT_S    = 60 // seconds
+	SCHEMA_FILE           string
+	PROXY_FALLBACK        = PROXY_ALLOW
+	PROXY_ROUTES          []proxyRoute
+	PUBLIC_BASE_URL       string
+	TRUSTED_PROXIES       []*net.IPNet
+	BASE_PATH             = "/fhir"
+	TENANTS_FILE          string
+	EXPORT_DIR            string
+	EXPORT_PAGE_SIZE      = 1000
+	EXPORT_EXPIRY         = time.Hour
+	ASYNC_WORKERS         = 4
+	ASYNC_QUEUE_SIZE      = 100
+	ASYNC_TIMEOUT         = 10 * time.Minute
+	ASYNC_EXPIRY          = time.Hour
+	UNRESOLVED_REFERENCES []string
+	FORWARD_HEADERS       []string
+	DROP_HEADERS          []string
+	LISTEN_TLS            *tls.Config
+	TLS_CLIENT_IDENTITIES map[string]clientIdentity
+	AUDIT_SINK            auditSink
+	OTLP_ENDPOINT         string
+	OTLP_HEADERS          map[string]string
+	OTLP_SERVICE_NAME     string
+	AUTH_KEYS             []authKey
+	AUTH_ISSUER           string
+	AUTH_AUDIENCE         string
+	AUTH_AUTHORIZE_URL    string
+	AUTH_TOKEN_URL        string
 )
 
 var (
-	client   *http.Client
-	log      *slog.Logger
-	upstream string
+	client         *http.Client
+	log            *slog.Logger
+	upstream       string
+	dumpSchemaPath string
+	defaultTenant  *Tenant
+	tenants        map[string]*Tenant
 )
 
 func init() {
+	// Logging Setup
 	logLevelStr := getEnv("RTG_LOG_LEVEL", "info")
-	switch strings.ToLower(logLevelStr) {
-	case "debug":
-		LOG_LEVEL = slog.LevelDebug
-	case "info":
-		LOG_LEVEL = slog.LevelInfo
-	case "warn":
-		LOG_LEVEL = slog.LevelWarn
-	case "error":
-		LOG_LEVEL = slog.LevelError
-	default:
-		LOG_LEVEL = slog.LevelInfo
-		fmt.Printf("Invalid log level: %s, using default: info\n", logLevelStr)
-	}
-	log = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: LOG_LEVEL}))
+	var validLevel bool
+	if LOG_LEVEL, validLevel = parseLogLevel(logLevelStr); !validLevel {
+		fmt.Fprintf(os.Stderr, "Invalid log level: %s, using default: info\n", logLevelStr)
+	}
+	LOG_FORMAT = strings.ToLower(getEnv("RTG_LOG_FORMAT", LOG_FORMAT_TEXT))
+	if LOG_FORMAT != LOG_FORMAT_TEXT && LOG_FORMAT != LOG_FORMAT_JSON {
+		fmt.Fprintf(os.Stderr, "Invalid log format: %s, using default: %s\n", LOG_FORMAT, LOG_FORMAT_TEXT)
+		LOG_FORMAT = LOG_FORMAT_TEXT
+	}
+	LOG_LEVEL_HEADER = getEnv("RTG_LOG_LEVEL_HEADER", "")
+	REDACT_PARAMS = parseNameList(getEnv("RTG_REDACT_PARAMS", DEFAULT_REDACT_PARAMS))
+	REDACT_ELEMENTS = parseNameList(getEnv("RTG_REDACT_ELEMENTS", DEFAULT_REDACT_ELEMENTS))
+	log = slog.New(newLogHandler(LOG_LEVEL))
+	slog.SetDefault(log)
+}
 
+// loadConfig reads the command line and the RTG_* settings. It runs from
+// main rather than init, so the package can be tested without arguments.
+func loadConfig() {
 	maxTimeout, err := strconv.Atoi(getEnv("RTG_MAX_STARTUP_WAIT_S", "60"))
-	if err != nil {
-		fmt.Printf("Invalid MAX_STARTUP_WAIT_S value: %s, using default: 60\n", getEnv("RTG_MAX_STARTUP_WAIT_S", "60"))
+	if err != nil || maxTimeout < 0 {
+		log.Warn("Invalid MAX_STARTUP_WAIT_S value, using default: 60", "value", getEnv("RTG_MAX_STARTUP_WAIT_S", "60"))
 		MAX_STARTUP_WAIT_S = 60
 	} else {
 		MAX_STARTUP_WAIT_S = maxTimeout
@@ -66,7 +118,7 @@ func init() {
 	portStr := getEnv("RTG_PORT", strconv.Itoa(DEFAULT_PORT))
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		fmt.Printf("Invalid port number: %s, using default: %d\n", portStr, DEFAULT_PORT)
+		log.Warn(fmt.Sprintf("Invalid port number, using default: %d", DEFAULT_PORT), "value", portStr)
 		PORT = DEFAULT_PORT
 	} else {
 		PORT = port
@@ -74,57 +126,223 @@ func init() {
 
 	flag.Parse()
 	args := flag.Args()
+	if len(args) > 0 && args[0] == "dump-schema" {
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "Usage: fhirrtg dump-schema <output-file|-> [upstream]")
+			os.Exit(1)
+		}
+		dumpSchemaPath = args[1]
+		args = args[2:]
+	}
 	if len(args) == 0 {
 		upstream = getEnv("RTG_UPSTREAM_SERVER", "")
 	} else {
 		upstream = args[0]
 	}
-	if upstream == "" {
-		fmt.Println("No upstream server specified")
-		os.Exit(1)
+	TENANTS_FILE = getEnv("RTG_TENANTS_FILE", "")
+	if upstream == "" && (TENANTS_FILE == "" || dumpSchemaPath != "") {
+		exitConfigError(fmt.Errorf("no upstream server specified"))
 	}
 
 	GQL_ACCEPT_HEADER = getEnv("RTG_GQL_ACCEPT_HEADER", DEFAULT_GQL_ACCEPT_HEADER)
 	HEALTHCHECK_PATH = getEnv("RTG_HEALTHCHECK_PATH", HEALTHCHECK_PATH)
+	METRICS_PATH = getEnv("RTG_METRICS_PATH", METRICS_PATH)
+	READINESS_PATH = getEnv("RTG_READINESS_PATH", READINESS_PATH)
+	READINESS_TIMEOUT = time.Duration(getEnvInt("RTG_READINESS_TIMEOUT_S", int(READINESS_TIMEOUT.Seconds()))) * time.Second
+	SCHEMA_FILE = getEnv("RTG_SCHEMA_FILE", "")
+	BASE_PATH = strings.TrimSuffix(getEnv("RTG_BASE_PATH", BASE_PATH), "/")
+	if BASE_PATH != "" && !strings.HasPrefix(BASE_PATH, "/") {
+		BASE_PATH = "/" + BASE_PATH
+	}
 
 	// HTTP Client Setup
 	skipTlsVerify := getEnv("RTG_SKIP_TLS_VERIFY", "false") == "true"
 	timeoutStr := getEnv("RTG_GRAPHQL_TIMEOUT", "30")
 	timeout, err := strconv.Atoi(timeoutStr)
 	if err != nil {
-		fmt.Printf("Invalid timeout value: %s, using default: 30\n", timeoutStr)
+		log.Warn("Invalid timeout value, using default: 30", "value", timeoutStr)
 		timeout = 30
 	}
 
+	tlsConfig, err := upstreamTLSConfig(
+		skipTlsVerify,
+		getEnv("RTG_UPSTREAM_CA_FILE", ""),
+		getEnv("RTG_UPSTREAM_CLIENT_CERT", ""),
+		getEnv("RTG_UPSTREAM_CLIENT_KEY", ""),
+	)
+	if err != nil {
+		exitConfigError(err)
+	}
+
 	client = &http.Client{
 		Timeout: time.Duration(timeout) * time.Second,
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: skipTlsVerify,
-			},
+			TLSClientConfig: tlsConfig,
 		},
 	}
+
+	// Listener TLS Setup
+	if tlsCert := getEnv("RTG_TLS_CERT", ""); tlsCert != "" {
+		LISTEN_TLS, err = listenerTLSConfig(
+			tlsCert,
+			getEnv("RTG_TLS_KEY", ""),
+			getEnv("RTG_TLS_CLIENT_CA", ""),
+			strings.ToLower(getEnv("RTG_TLS_CLIENT_AUTH", CLIENT_AUTH_REQUIRE)),
+		)
+		if err != nil {
+			exitConfigError(err)
+		}
+	}
+	if identityFile := getEnv("RTG_TLS_CLIENT_IDENTITIES", ""); identityFile != "" {
+		TLS_CLIENT_IDENTITIES, err = loadClientIdentities(identityFile)
+		if err != nil {
+			exitConfigError(err)
+		}
+	}
+
+	// Upstream Header Setup
+	FORWARD_HEADERS = parseHeaderList(getEnv("RTG_FORWARD_HEADERS", ""))
+	DROP_HEADERS = parseHeaderList(getEnv("RTG_DROP_HEADERS", "Cookie"))
+
+	// Public URL Setup
+	PUBLIC_BASE_URL = strings.TrimSuffix(getEnv("RTG_PUBLIC_BASE_URL", ""), "/")
+	TRUSTED_PROXIES, err = parseTrustedProxies(getEnv("RTG_TRUSTED_PROXIES", ""))
+	if err != nil {
+		exitConfigError(err)
+	}
+
+	// Proxy Setup
+	PROXY_FALLBACK = strings.ToLower(getEnv("RTG_PROXY_FALLBACK", PROXY_FALLBACK))
+	if PROXY_FALLBACK != PROXY_ALLOW && PROXY_FALLBACK != PROXY_DENY {
+		log.Warn(fmt.Sprintf("Invalid proxy fallback, using default: %s", PROXY_ALLOW), "value", PROXY_FALLBACK)
+		PROXY_FALLBACK = PROXY_ALLOW
+	}
+	PROXY_ROUTES, err = parseProxyRoutes(getEnv("RTG_PROXY_ROUTES", ""))
+	if err != nil {
+		exitConfigError(err)
+	}
+
+	// Error Mapping
+	if err := parseUpstreamErrorStatus(getEnv("RTG_UPSTREAM_ERROR_STATUS", "")); err != nil {
+		exitConfigError(err)
+	}
+
+	// Authorization Setup
+	AUTH_ISSUER = getEnv("RTG_AUTH_ISSUER", "")
+	AUTH_AUDIENCE = getEnv("RTG_AUTH_AUDIENCE", "")
+	AUTH_AUTHORIZE_URL = getEnv("RTG_AUTH_AUTHORIZE_URL", "")
+	AUTH_TOKEN_URL = getEnv("RTG_AUTH_TOKEN_URL", "")
+	if jwksFile := getEnv("RTG_AUTH_JWKS_FILE", ""); jwksFile != "" {
+		AUTH_KEYS, err = loadJWKS(jwksFile)
+		if err != nil {
+			exitConfigError(err)
+		}
+	}
+	if secret := getEnv("RTG_AUTH_SECRET", ""); secret != "" {
+		AUTH_KEYS = append(AUTH_KEYS, authKey{key: []byte(secret)})
+	}
+
+	// Audit Setup
+	AUDIT_SINK, err = newAuditSink(getEnv("RTG_AUDIT_SINK", ""))
+	if err != nil {
+		exitConfigError(err)
+	}
+
+	// Tracing Setup
+	OTLP_ENDPOINT = getEnv("RTG_OTLP_ENDPOINT", "")
+	OTLP_SERVICE_NAME = getEnv("RTG_OTLP_SERVICE_NAME", "fhirrtg")
+	OTLP_HEADERS, err = parseOTLPHeaders(getEnv("RTG_OTLP_HEADERS", ""))
+	if err != nil {
+		exitConfigError(err)
+	}
+
+	// Search Setup
+	UNRESOLVED_REFERENCES, err = parseUnresolvedReferences(getEnv("RTG_UNRESOLVED_REFERENCES", ""))
+	if err != nil {
+		exitConfigError(err)
+	}
+
+	// Bulk Export Setup
+	EXPORT_DIR = getEnv("RTG_EXPORT_DIR", filepath.Join(os.TempDir(), "fhirrtg-export"))
+	EXPORT_PAGE_SIZE = getEnvInt("RTG_EXPORT_PAGE_SIZE", EXPORT_PAGE_SIZE)
+	EXPORT_EXPIRY = time.Duration(getEnvInt("RTG_EXPORT_EXPIRY_S", int(EXPORT_EXPIRY.Seconds()))) * time.Second
+
+	// Async Request Setup
+	ASYNC_WORKERS = getEnvInt("RTG_ASYNC_WORKERS", ASYNC_WORKERS)
+	ASYNC_QUEUE_SIZE = getEnvInt("RTG_ASYNC_QUEUE_SIZE", ASYNC_QUEUE_SIZE)
+	ASYNC_TIMEOUT = time.Duration(getEnvInt("RTG_ASYNC_TIMEOUT_S", int(ASYNC_TIMEOUT.Seconds()))) * time.Second
+	ASYNC_EXPIRY = time.Duration(getEnvInt("RTG_ASYNC_EXPIRY_S", int(ASYNC_EXPIRY.Seconds()))) * time.Second
+	asyncQueue = make(chan *asyncJob, ASYNC_QUEUE_SIZE)
+	asyncClient = &http.Client{Transport: client.Transport}
+	asyncResult, err = newAsyncStore(
+		strings.ToLower(getEnv("RTG_ASYNC_STORAGE", ASYNC_STORAGE_MEMORY)),
+		getEnv("RTG_ASYNC_DIR", filepath.Join(os.TempDir(), "fhirrtg-async")),
+	)
+	if err != nil {
+		exitConfigError(err)
+	}
+
+	// Tenant Setup
+	if upstream != "" {
+		defaultTenant, err = newTenant("", upstream, SCHEMA_FILE, nil)
+		if err != nil {
+			exitConfigError(err)
+		}
+		if tokenURL := getEnv("RTG_UPSTREAM_TOKEN_URL", ""); tokenURL != "" {
+			defaultTenant.OAuth2 = &oauth2Config{
+				TokenURL:     tokenURL,
+				ClientID:     getEnv("RTG_UPSTREAM_CLIENT_ID", ""),
+				ClientSecret: getEnv("RTG_UPSTREAM_CLIENT_SECRET", ""),
+				Scope:        getEnv("RTG_UPSTREAM_SCOPE", ""),
+			}
+			if err := defaultTenant.OAuth2.validate(); err != nil {
+				exitConfigError(err)
+			}
+		}
+	}
+	if TENANTS_FILE != "" {
+		tenants, err = loadTenants(TENANTS_FILE)
+		if err != nil {
+			exitConfigError(err)
+		}
+	}
+}
+
+// exitConfigError logs an invalid setting and stops the server
+func exitConfigError(err error) {
+	log.Error("Invalid configuration", "error", err)
+	os.Exit(1)
 }
 
 func fhirSearch(w http.ResponseWriter, req *http.Request, resourceType string) {
-	ctxLog := LoggerFromRequest(req)
+	req, authErr := restrictSearchToPatient(req, resourceType)
+	if authErr != nil {
+		sendAuthError(w, req, authErr)
+		return
+	}
+
+	_, buildSpan := startSpan(req.Context(), "build query", SPAN_KIND_INTERNAL)
+	defer buildSpan.End()
+
+	schema := TenantFromRequest(req).Schema
 	queryString := req.URL.Query()
 	profile := queryString.Get("_profile")
-	fragment := GenerateFragment(resourceType)
+	fragment := GenerateFragment(schema, resourceType)
 	fragments := map[string]gql.Fragment{resourceType: fragment}
 
 	var includes []IncludeParam
 	includeParams := queryString["_include"]
 	for _, includeParam := range includeParams {
-		include, err := parseIncludeParam(includeParam)
+		include, err := parseIncludeParam(schema, includeParam)
 		if err != nil {
+			buildSpan.SetError(err.Error())
 			SendError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		// Generate fragments for the possible types
 		for _, possibleType := range include.PossibleTypes {
-			fragments[possibleType] = GenerateFragment(possibleType)
+			fragments[possibleType] = GenerateFragment(schema, possibleType)
 		}
 		includes = append(includes, include)
 	}
@@ -132,15 +350,30 @@ func fhirSearch(w http.ResponseWriter, req *http.Request, resourceType string) {
 	var revincludes []IncludeParam
 	revincludeParams := queryString["_revinclude"]
 	for _, revincludeParams := range revincludeParams {
-		revinclude, err := parseIncludeParam(revincludeParams)
+		revinclude, err := parseIncludeParam(schema, revincludeParams)
 		if err != nil {
+			buildSpan.SetError(err.Error())
 			SendError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		// Generate fragment for the revinclude type
-		fragments[revinclude.ResourceName] = GenerateFragment(revinclude.ResourceName)
-		revincludes = append(includes, revinclude)
+		fragments[revinclude.ResourceName] = GenerateFragment(schema, revinclude.ResourceName)
+		revincludes = append(revincludes, revinclude)
+	}
+
+	// Included resources need scopes of their own
+	var includedTypes []string
+	for _, include := range includes {
+		includedTypes = append(includedTypes, include.PossibleTypes...)
+	}
+	for _, revinclude := range revincludes {
+		includedTypes = append(includedTypes, revinclude.ResourceName)
+	}
+	if authErr := authorizeTypes(req, includedTypes, "r"); authErr != nil {
+		buildSpan.SetError(authErr.Error())
+		sendAuthError(w, req, authErr)
+		return
 	}
 
 	var searchParams = make(gql.Arguments)
@@ -158,6 +391,16 @@ func fhirSearch(w http.ResponseWriter, req *http.Request, resourceType string) {
 
 	query := FullResourceRequest(resourceType, searchParams, includes, revincludes, fragments)
 	gqlStr += query.String()
+	buildSpan.SetAttributes("fhir.resource_type", resourceType, "graphql.fragments", len(fragments))
+	buildSpan.End()
+
+	sendSearchResult(w, req, gqlStr, profile)
+}
+
+// sendSearchResult runs a search query upstream and returns the result as a
+// searchset Bundle
+func sendSearchResult(w http.ResponseWriter, req *http.Request, gqlStr string, profile string) {
+	ctxLog := LoggerFromRequest(req)
 
 	response, err := GqlRequest(gqlStr, profile, req)
 	if err != nil || response == nil {
@@ -175,10 +418,12 @@ func fhirSearch(w http.ResponseWriter, req *http.Request, resourceType string) {
 	}
 
 	copyHeaders(w.Header(), response.Header)
+	// The body is rewritten, so the upstream length no longer applies
+	w.Header().Del("Content-Length")
 	SendBundle(w, body, response.StatusCode, req)
 }
 
-func validateResource(resourceType string) error {
+func validateResource(schemaDict map[string]gql.SchemaType, resourceType string) error {
 	if _, exists := schemaDict[resourceType]; !exists {
 		return fmt.Errorf("unknown resource type: %s", resourceType)
 	}
@@ -186,33 +431,30 @@ func validateResource(resourceType string) error {
 	return nil
 }
 
+// FHIR ids are 1-64 letters, digits, '-' and '.'
+var resourceIDPattern = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`)
+
+func validateResourceID(id string) error {
+	if !resourceIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid resource id: %s", id)
+	}
+	return nil
+}
+
 func fhirRead(w http.ResponseWriter, req *http.Request, resourceType string, id string) {
 	ctxLog := LoggerFromRequest(req)
 
-	queryString := req.URL.Query()
-	profile := queryString.Get("_profile")
-	fragment := GenerateFragment(resourceType)
-	fragments := map[string]gql.Fragment{resourceType: fragment}
-
-	query := gql.Query{
-		Operation: "query",
-		Name:      "Get" + resourceType,
-		Fields: []gql.Field{
-			{
-				Name: resourceType,
-				Arguments: gql.Arguments{
-					"id": gql.ArgumentValue{Value: id},
-				},
-				Fragments: []gql.Fragment{fragments[resourceType]},
-			},
-		},
+	if err := validateResourceID(id); err != nil {
+		SendIssue(w, "invalid", err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	gqlStr := ""
-	for _, fragment := range fragments {
-		gqlStr += fragment.String() + "\n"
-	}
-	gqlStr += query.String()
+	queryString := req.URL.Query()
+	profile := queryString.Get("_profile")
+	_, buildSpan := startSpan(req.Context(), "build query", SPAN_KIND_INTERNAL)
+	gqlStr := ReadRequest(TenantFromRequest(req).Schema, resourceType, id)
+	buildSpan.SetAttributes("fhir.resource_type", resourceType)
+	buildSpan.End()
 
 	response, err := GqlRequest(gqlStr, profile, req)
 	if err != nil || response == nil {
@@ -230,14 +472,28 @@ func fhirRead(w http.ResponseWriter, req *http.Request, resourceType string, id
 	}
 
 	copyHeaders(w.Header(), response.Header)
-	SendReadResult(w, body, response.StatusCode)
+	// The body is rewritten, so the upstream length no longer applies
+	w.Header().Del("Content-Length")
+	SendReadResult(w, body, response.StatusCode, req)
 }
 
+// SendError writes an OperationOutcome with the FHIR issue type of the HTTP
+// status code
 func SendError(w http.ResponseWriter, msg string, code int) {
-	body := OperationOutcome(strconv.Itoa(code), msg, nil)
-	w.Header().Set("Content-Type", "application/fhir+json; charset=utf-8")
-	w.WriteHeader(code)
-	w.Write(body)
+	body := OperationOutcome(statusIssueType(code), msg, nil)
+	writeFhir(w, code, body)
+}
+
+// sendNotReady answers requests for a tenant whose schema is not loaded yet
+func sendNotReady(w http.ResponseWriter, tenant *Tenant) {
+	w.Header().Set("Retry-After", strconv.Itoa(tenant.retryAfter()))
+	SendIssue(w, "transient", "The upstream schema is not loaded yet, retry later", http.StatusServiceUnavailable)
+}
+
+// SendIssue writes an OperationOutcome with a FHIR issue type code
+func SendIssue(w http.ResponseWriter, issueType string, msg string, code int) {
+	body := OperationOutcome(issueType, msg, nil)
+	writeFhir(w, code, body)
 }
 
 func dispatch(w http.ResponseWriter, req *http.Request) {
@@ -246,111 +502,170 @@ func dispatch(w http.ResponseWriter, req *http.Request) {
 	// Ignore Accept-encoding (gzip, deflate, br)
 	req.Header.Del("Accept-Encoding")
 
-	// Remove /fhir prefix if present
-	// TODO: Make this configurable
-	if strings.HasPrefix(req.URL.Path, "/fhir") {
-		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/fhir")
-		if req.URL.Path == "" {
-			req.URL.Path = "/"
+	if METRICS_PATH != "" && req.Method == http.MethodGet && req.URL.Path == METRICS_PATH {
+		metricsHandler(w, req)
+		return
+	}
+
+	// Probes are answered outside the base path and tenants
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		switch {
+		case req.URL.Path == HEALTHCHECK_PATH:
+			livenessHandler(w, req)
+			return
+		case READINESS_PATH != "" && req.URL.Path == READINESS_PATH:
+			readinessHandler(w, req)
+			return
 		}
 	}
 
-	switch req.Method {
-	case http.MethodPost:
-		fmt.Println("Request Method: POST")
-		pathComponents := strings.Split(req.URL.Path, "/")
-
-		switch len(pathComponents) {
-		case 1:
-			// Server Root
-			ctxLog.Info("No path components")
-		case 2:
-			/// Create Resource
-			ctxLog.Info("Create Resource", "type", pathComponents[1])
-			FhirCreate(w, req, pathComponents[1])
-		case 3:
-			// Update Resource
-		default:
-			ctxLog.Error("Bad Request")
-			SendError(w, "Bad Request", http.StatusBadRequest)
+	// Select the tenant and remove the tenant and base path prefixes
+	req, tenant := routeRequest(req)
+	if tenant == nil {
+		ctxLog.Info("No upstream for path")
+		SendError(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	format, err := negotiateFormat(req)
+	if err != nil {
+		SendError(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	schema, _ := tenant.currentSchema()
+	w = &formatWriter{ResponseWriter: w, format: format, pretty: prettyRequested(req), schema: schema}
+
+	// Liveness probes below the base path keep working
+	if req.Method == http.MethodGet && req.URL.Path == HEALTHCHECK_PATH {
+		livenessHandler(w, req)
+		return
+	}
+
+	if authEnabled() && req.Method == http.MethodGet && req.URL.Path == SMART_CONFIGURATION_PATH {
+		smartConfigurationHandler(w, req)
+		return
+	}
+
+	// Audited from here, so requests rejected for their token are recorded
+	w, recordAudit := startAudit(w, req, schema)
+	defer func() { recordAudit(req) }()
+
+	req = withClientIdentity(req)
+	req, authErr := authenticate(req)
+	if authErr != nil {
+		sendAuthError(w, req, authErr)
+		return
+	}
+
+	if schema == nil {
+		sendNotReady(w, tenant)
+		return
+	}
+	routeFhirRequest(w, req, schema)
+}
+
+// startSchemaLoader loads the schema of tenant. A schema file is loaded
+// before the server starts; introspection runs in the background, so the
+// server answers health checks while the upstream is unavailable.
+func startSchemaLoader(tenant *Tenant) {
+	if tenant.SchemaFile != "" {
+		log.Info("Loading schema from file", "tenant", tenant.String(), "file", tenant.SchemaFile)
+		if err := tenant.loadSchema(); err != nil {
+			log.Error("Failed to load schema", "tenant", tenant.String(), "error", err)
+			os.Exit(1)
 		}
+		log.Info("Loaded schema from file", "tenant", tenant.String(), "types", len(tenant.Schema))
+		return
+	}
+
+	log.Info("Loading schema from upstream in the background", "tenant", tenant.String(), "max_wait_s", MAX_STARTUP_WAIT_S)
+	go introspectWithBackoff(tenant)
+}
 
-	case http.MethodGet:
-		if req.URL.Path == HEALTHCHECK_PATH {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
+// introspectWithBackoff introspects the upstream of tenant until it succeeds,
+// waiting exponentially longer between attempts. The process exits when
+// MAX_STARTUP_WAIT_S is exceeded, unless it is 0.
+func introspectWithBackoff(tenant *Tenant) {
+	startupAt := time.Now()
+	backoff := STARTUP_BACKOFF_INITIAL
+	for attempt := 1; ; attempt++ {
+		err := tenant.loadSchema()
+		if err == nil {
+			log.Info("Loaded schema from upstream", "tenant", tenant.String(), "types", len(tenant.Schema), "attempts", attempt)
 			return
 		}
-
-		pathComponents := strings.Split(req.URL.Path, "/")
-		switch len(pathComponents) {
-		case 1:
-			// Server Root
-			ctxLog.Info("No path components")
-			ProxyRequest(w, req)
-		case 2:
-			/// Resource Type Search
-			if err := validateResource(pathComponents[1]); err != nil {
-				// Invalid resource type, proxy the request
-				ProxyRequest(w, req)
-				return
-			}
-			fhirSearch(w, req, pathComponents[1])
-		case 3:
-			// Resource Type Read
-			if err := validateResource(pathComponents[1]); err != nil {
-				// Invalid resource type, proxy the request
-				ProxyRequest(w, req)
-				return
-			}
-			fhirRead(w, req, pathComponents[1], pathComponents[2])
-		case 4:
-			// Compartment Search
-			ctxLog.Info("Component Search", "component", pathComponents[1], "id", pathComponents[2], "type", pathComponents[3])
-		default:
-			ctxLog.Error("Bad Request")
-			SendError(w, "Bad Request", http.StatusBadRequest)
+		if MAX_STARTUP_WAIT_S > 0 && time.Since(startupAt) > time.Duration(MAX_STARTUP_WAIT_S)*time.Second {
+			log.Error("Failed to connect to upstream server", "tenant", tenant.String(), "max_startup_wait_s", MAX_STARTUP_WAIT_S, "error", err)
+			os.Exit(1)
 		}
 
-	default:
-		ctxLog.Info("Request Method: Other")
+		delay := withJitter(backoff)
+		tenant.nextAttempt.Store(time.Now().Add(delay).UnixNano())
+		log.Warn("Upstream server not available, retrying...", "tenant", tenant.String(), "attempt", attempt, "retry_in", delay.Round(time.Millisecond), "error", err)
+		time.Sleep(delay)
+		backoff = min(2*backoff, STARTUP_BACKOFF_MAX)
 	}
 }
 
+// withJitter returns a random duration between half of d and d, so replicas
+// started together do not retry in lockstep
+func withJitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
+
 func main() {
-	fmt.Printf("Starting FHIR RTG server with upstream %s for %d seconds...\n\n", upstream, MAX_STARTUP_WAIT_S)
+	loadConfig()
 
-	startupAt := time.Now()
-	for {
-		err := introspect()
-		if err == nil {
-			break
-		}
-		if time.Since(startupAt) > time.Duration(MAX_STARTUP_WAIT_S)*time.Second {
-			fmt.Fprintf(os.Stderr, "\nFailed to connect to upstream server %s within %d seconds\n\n", upstream, MAX_STARTUP_WAIT_S)
+	if dumpSchemaPath != "" {
+		if err := dumpSchema(defaultTenant, dumpSchemaPath); err != nil {
+			fmt.Fprintf(os.Stderr, "\nFailed to dump schema from %s: %s\n\n", upstream, err)
 			os.Exit(1)
 		}
-		log.Warn("Upstream server not available, retrying...", "error", err)
-		time.Sleep(5 * time.Second)
+		if dumpSchemaPath != "-" {
+			fmt.Printf("Wrote %d FHIR resource types from %s to %s\n", len(defaultTenant.Schema), upstream, dumpSchemaPath)
+		}
+		return
+	}
+
+	for _, tenant := range allTenants() {
+		startSchemaLoader(tenant)
 	}
 
-	fmt.Printf("Startup successful! Loaded %d FHIR resource types\n", len(schemaDict))
-	fmt.Println(`
+	// The banner goes to stderr, stdout only has log records
+	fmt.Fprintln(os.Stderr, `
 	    ________  __________     ____  ____________
 	   / ____/ / / /  _/ __ \   / __ \/_  __/ ____/
 	  / /_  / /_/ // // /_/ /  / /_/ / / / / / __  
 	 / __/ / __  // // _, _/  / _, _/ / / / /_/ /  
 	/_/   /_/ /_/___/_/ |_|  /_/ |_| /_/  \____/   
 	`)
-	fmt.Printf("FHIR RTG server version %s\n", VERSION)
-	fmt.Printf("Connected to : %s\n", upstream)
-	fmt.Printf("Log level: %s | Healthcheck path: %s\n", LOG_LEVEL.String(), HEALTHCHECK_PATH)
-	fmt.Printf("Awaiting connections on port %d\n\n", PORT)
-	log.Info(fmt.Sprintf("FHIR RTG started with upstream server %s", upstream))
+	fmt.Fprintf(os.Stderr, "FHIR RTG server version %s\n", VERSION)
+	for _, tenant := range allTenants() {
+		fmt.Fprintf(os.Stderr, "Connected to : %s\n", tenant)
+	}
+	fmt.Fprintf(os.Stderr, "Log level: %s | Healthcheck path: %s | Readiness path: %s | Base path: %s\n", LOG_LEVEL.String(), HEALTHCHECK_PATH, READINESS_PATH, BASE_PATH)
+	if LISTEN_TLS != nil {
+		fmt.Fprintf(os.Stderr, "Awaiting TLS connections on port %d\n\n", PORT)
+	} else {
+		fmt.Fprintf(os.Stderr, "Awaiting connections on port %d\n\n", PORT)
+	}
+	log.Info(fmt.Sprintf("FHIR RTG started with upstream server %s", upstream),
+		"version", VERSION,
+		"tenants", len(tenants),
+		"port", PORT,
+		"tls", LISTEN_TLS != nil,
+		"base_path", BASE_PATH,
+	)
+
+	go expireExportJobs()
+	startAsyncWorkers()
+	startAuditWriter()
+	startTraceExporter()
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", PORT),
-		Handler: LoggingMiddleware(http.HandlerFunc(dispatch)),
+		Addr:      fmt.Sprintf(":%d", PORT),
+		Handler:   LoggingMiddleware(http.HandlerFunc(dispatch)),
+		TLSConfig: LISTEN_TLS,
 	}
 
 	// Channel to listen for interrupt signals
@@ -359,7 +674,14 @@ func main() {
 
 	// Start server in a goroutine
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if LISTEN_TLS != nil {
+			// The certificate comes from TLSConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Error("FHIR RTG failed to start", "error", err)
 			os.Exit(1)
 		}
@@ -377,5 +699,7 @@ func main() {
 		log.Error("FHIR RTG forced to shutdown", "error", err)
 	}
 
+	stopAuditWriter()
+	stopTraceExporter()
 	log.Info("FHIR RTG stopped")
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics in the text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	sizeBuckets    = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576}
+	entryBuckets   = []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000}
+)
+
+var (
+	httpRequests = newCounterVec("fhirrtg_http_requests_total",
+		"FHIR requests handled.", "interaction", "type", "status")
+	httpDuration = newHistogramVec("fhirrtg_http_request_duration_seconds",
+		"Time to handle a FHIR request.", latencyBuckets, "interaction", "type", "status")
+	upstreamDuration = newHistogramVec("fhirrtg_upstream_request_duration_seconds",
+		"Latency of upstream GraphQL requests.", latencyBuckets, "tenant")
+	upstreamErrors = newCounterVec("fhirrtg_upstream_errors_total",
+		"Failed upstream GraphQL requests by reason (transport, status).", "tenant", "reason")
+	upstreamQueryBytes = newHistogramVec("fhirrtg_upstream_query_bytes",
+		"Size of upstream GraphQL queries.", sizeBuckets, "tenant")
+	bundleEntries = newHistogramVec("fhirrtg_bundle_entries",
+		"Entries per searchset Bundle.", entryBuckets, "type")
+	schemaTypes = newGaugeVec("fhirrtg_schema_types",
+		"FHIR resource types in the loaded schema.", "tenant")
+	schemaIntrospected = newGaugeVec("fhirrtg_schema_last_introspection_timestamp_seconds",
+		"Time of the last successful schema introspection.", "tenant")
+
+	allMetrics = []metric{
+		httpRequests, httpDuration,
+		upstreamDuration, upstreamErrors, upstreamQueryBytes,
+		bundleEntries, schemaTypes, schemaIntrospected,
+	}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// series are the label values of a metric, in label order
+type series struct {
+	labels []string
+	value  float64
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// valueVec holds the series of a counter or gauge
+type valueVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newCounterVec(name string, help string, labels ...string) *valueVec {
+	return &valueVec{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*series)}
+}
+
+func newGaugeVec(name string, help string, labels ...string) *valueVec {
+	return &valueVec{name: name, help: help, kind: "gauge", labels: labels, series: make(map[string]*series)}
+}
+
+func (v *valueVec) get(labelValues []string) *series {
+	key := seriesKey(labelValues)
+	s, exists := v.series[key]
+	if !exists {
+		s = &series{labels: labelValues}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Add adds delta to the series with the label values
+func (v *valueVec) Add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(labelValues).value += delta
+}
+
+func (v *valueVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Set sets the series with the label values, for gauges
+func (v *valueVec) Set(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(labelValues).value = value
+}
+
+func (v *valueVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	for _, key := range sortedKeys(v.series) {
+		s := v.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labels), formatFloat(s.value))
+	}
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// Observe adds a value to the series with the label values
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := seriesKey(labelValues)
+	s, exists := h.series[key]
+	if !exists {
+		s = &histogram{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tenantLabel names a tenant in metric labels
+func tenantLabel(tenant *Tenant) string {
+	if tenant == nil || tenant.Name == "" {
+		return "default"
+	}
+	return tenant.Name
+}
+
+// observeRequest records a handled request. Requests that matched no FHIR
+// route have an empty interaction.
+func observeRequest(params RouteParams, status int, duration time.Duration) {
+	statusLabel := strconv.Itoa(status)
+	httpRequests.Inc(params.Interaction, params.Type, statusLabel)
+	httpDuration.Observe(duration.Seconds(), params.Interaction, params.Type, statusLabel)
+}
+
+// observeSchema records the schema a tenant has loaded
+func observeSchema(tenant *Tenant, introspected bool) {
+	schemaTypes.Set(float64(len(tenant.Schema)), tenantLabel(tenant))
+	if introspected {
+		schemaIntrospected.Set(float64(time.Now().Unix()), tenantLabel(tenant))
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	for _, m := range allMetrics {
+		m.write(&buf)
+	}
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type ctxLoggerKey struct{}
+type ctxTraceIDKey struct{}
+
+// ctxRouteSlotKey holds a *RouteParams that withRoute fills in, so the
+// middleware can label metrics with the matched route
+type ctxRouteSlotKey struct{}
 
 // ResponseWriter wrapper to capture status code
 type statusRecorder struct {
@@ -22,12 +26,8 @@ func (r *statusRecorder) WriteHeader(code int) {
 	r.ResponseWriter.WriteHeader(code)
 }
 
-func generateTraceID() (string, error) {
-	bytes := make([]byte, 8) // 16 hex characters
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(bytes), nil
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
 }
 
 // Middleware that logs every request with timing, status, and query params
@@ -35,12 +35,17 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
+		serverSpan := startServerSpan(r)
+		defer serverSpan.End()
+
+		// The request id defaults to the W3C trace id, so logs, AuditEvents
+		// and traces of a request share one id
 		traceID := r.Header.Get("X-Request-ID")
 		if traceID == "" {
-			traceID, _ = generateTraceID()
+			traceID = serverSpan.TraceID
 		}
 
-		logger := slog.Default().With(
+		logger := requestLogger(r).With(
 			"ip", clientIP(r),
 			"user_agent", r.UserAgent(),
 			"method", r.Method,
@@ -48,13 +53,30 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 			"query", r.URL.RawQuery,
 			"trace_id", traceID,
 		)
+		if traceID != serverSpan.TraceID {
+			logger = logger.With("otel_trace_id", serverSpan.TraceID)
+		}
 		ctx := context.WithValue(r.Context(), ctxLoggerKey{}, logger)
+		ctx = contextWithSpan(ctx, serverSpan)
+		ctx = context.WithValue(ctx, ctxTraceIDKey{}, traceID)
+		route := &RouteParams{}
+		ctx = context.WithValue(ctx, ctxRouteSlotKey{}, route)
 
 		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
 
 		next.ServeHTTP(rec, r.WithContext(ctx))
 
 		duration := time.Since(start)
+		observeRequest(*route, rec.status, duration)
+
+		if route.Interaction != "" {
+			serverSpan.Name = strings.TrimSpace(route.Interaction + " " + route.Type)
+			serverSpan.SetAttributes("fhir.interaction", route.Interaction, "fhir.resource_type", route.Type)
+		}
+		serverSpan.SetAttributes("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			serverSpan.SetError(http.StatusText(rec.status))
+		}
 
 		// Log everything including query parameters
 		logger.Info("request completed",
@@ -72,6 +94,12 @@ func LoggerFromContext(ctx context.Context) *slog.Logger {
 	return slog.Default()
 }
 
+// TraceIDFromRequest returns the trace id LoggingMiddleware assigned to r
+func TraceIDFromRequest(r *http.Request) string {
+	traceID, _ := r.Context().Value(ctxTraceIDKey{}).(string)
+	return traceID
+}
+
 func LoggerFromRequest(r *http.Request) *slog.Logger {
 	var logger *slog.Logger
 	if r != nil {
@@ -6,12 +6,11 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"time"
 
 	"github.com/fhirrtg/fhirrtg/gql"
 )
 
-func generateCreateMutation(resourceType string, body []byte) (string, error) {
+func generateCreateMutation(schemaDict map[string]gql.SchemaType, resourceType string, body []byte) (string, error) {
 	var resource map[string]interface{}
 	err := json.Unmarshal(body, &resource)
 	if err != nil {
@@ -28,7 +27,7 @@ func generateCreateMutation(resourceType string, body []byte) (string, error) {
 		return "", err
 	}
 
-	returnFragment := GenerateFragment(resourceType)
+	returnFragment := GenerateFragment(schemaDict, resourceType)
 
 	primaryField := gql.Field{
 		Name: fmt.Sprintf("%sCreate", resourceType),
@@ -50,6 +49,35 @@ func generateCreateMutation(resourceType string, body []byte) (string, error) {
 	return gqlStr, nil
 }
 
+func generateUpdateMutation(schemaDict map[string]gql.SchemaType, resourceType string, id string, resource map[string]interface{}) (string, error) {
+	resourceBytes, err := json.Marshal(resource)
+	if err != nil {
+		slog.Error("Failed to marshal resource body", "error", err)
+		return "", err
+	}
+
+	returnFragment := GenerateFragment(schemaDict, resourceType)
+
+	primaryField := gql.Field{
+		Name: fmt.Sprintf("%sUpdate", resourceType),
+		Arguments: gql.Arguments{
+			"id":       gql.ArgumentValue{Value: id},
+			"resource": gql.ArgumentValue{Value: string(resourceBytes)},
+		},
+		Fragments: []gql.Fragment{returnFragment},
+	}
+
+	gqlStr := returnFragment.String() + "\n"
+
+	mutation := gql.Query{
+		Operation: "mutation",
+		Name:      fmt.Sprintf("%sUpdateMutation", resourceType),
+		Fields:    []gql.Field{primaryField},
+	}
+	gqlStr += mutation.String()
+	return gqlStr, nil
+}
+
 func FhirCreate(w http.ResponseWriter, req *http.Request, resourceType string) {
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
@@ -57,85 +85,147 @@ func FhirCreate(w http.ResponseWriter, req *http.Request, resourceType string) {
 		return
 	}
 
+	if isXMLContentType(req.Header.Get("Content-Type")) {
+		body, err = fhirXMLToJSON(body, TenantFromRequest(req).Schema)
+		if err != nil {
+			SendError(w, "Invalid FHIR XML: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	profile := req.URL.Query().Get("_profile")
-	gqlStr, err := generateCreateMutation(resourceType, body)
+	gqlStr, err := generateCreateMutation(TenantFromRequest(req).Schema, resourceType, body)
 	if err != nil {
 		SendError(w, "Failed to generate GraphQL mutation", http.StatusInternalServerError)
 		return
 	}
 
-	resp, err := GqlRequest(gqlStr, profile, req)
+	response, err := GqlRequest(gqlStr, profile, req)
+	if err != nil {
+		SendError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		SendError(w, err.Error(), resp.StatusCode)
+		LoggerFromRequest(req).Error("Error reading response body:", "error", err)
+		SendError(w, err.Error(), http.StatusBadGateway)
 		return
 	}
-	// resource := ProcessCreate(resp, req)
-	w.Write(body)
-	// w.Write(resp) --- IGNORE ---
+	SendCreateResult(w, responseBody, response.StatusCode, req, resourceType)
 }
 
-func ProcessCreate(body []byte, req *http.Request) []byte {
-	var result map[string]interface{}
-	err := json.Unmarshal(body, &result)
+// FhirUpdate writes a resource with the update mutation. The body must have
+// the resource type and id of the URL.
+func FhirUpdate(w http.ResponseWriter, req *http.Request, resourceType string, id string) {
+	ctxLog := LoggerFromRequest(req)
+	schema := TenantFromRequest(req).Schema
+	profile := req.URL.Query().Get("_profile")
+
+	if err := validateResourceID(id); err != nil {
+		SendIssue(w, "invalid", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
 	if err != nil {
-		// Return original if we can't unmarshal
-		return body
+		SendError(w, "Failed to read request body", http.StatusBadRequest)
+		return
 	}
 
-	// Check if there is an error key and return the original body if it exists
-	if errorVal, hasError := result["errors"]; hasError && errorVal != nil {
-		return body
+	if isXMLContentType(req.Header.Get("Content-Type")) {
+		body, err = fhirXMLToJSON(body, schema)
+		if err != nil {
+			SendError(w, "Invalid FHIR XML: "+err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
 	var resource map[string]interface{}
+	if err := unmarshalJSONNumbers(body, &resource); err != nil || resource == nil {
+		SendIssue(w, "invalid", "Request body is not a FHIR resource", http.StatusBadRequest)
+		return
+	}
+	if resource["resourceType"] != resourceType {
+		SendIssue(w, "invalid", fmt.Sprintf("Resource type %v does not match %s", resource["resourceType"], resourceType), http.StatusBadRequest)
+		return
+	}
+	if resource["id"] != id {
+		SendIssue(w, "invalid", fmt.Sprintf("Resource id %v does not match %s", resource["id"], id), http.StatusBadRequest)
+		return
+	}
 
-	// Extract the resource from data.[resourceType] structure
-	if data, ok := result["data"].(map[string]interface{}); ok {
-		// get the first key in data
-		for _, v := range data {
-			if res, ok := v.(map[string]interface{}); ok {
-				resource = res
-				break
-			}
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		current, statusCode, err := readCurrentResource(req, resourceType, id, profile)
+		if err != nil {
+			sendReadError(w, err, statusCode)
+			return
+		}
+		if versionID := resourceVersion(current); parseETag(ifMatch) != versionID {
+			ctxLog.Info("Version conflict", "if_match", ifMatch, "version", versionID)
+			SendError(w, fmt.Sprintf("Version %s does not match current version %s", ifMatch, versionID), http.StatusPreconditionFailed)
+			return
 		}
 	}
 
-	if resource == nil {
-		// Return original if we couldn't find the resource
-		return body
+	gqlStr, err := generateUpdateMutation(schema, resourceType, id, resource)
+	if err != nil {
+		SendError(w, "Failed to generate GraphQL mutation", http.StatusInternalServerError)
+		return
 	}
 
-	bundle := map[string]interface{}{
-		"resourceType": "Bundle",
-		"type":         "transaction-response",
-		"entry": []interface{}{
-			map[string]interface{}{
-				"resource": resource,
-				"response": map[string]interface{}{
-					"status":   "201 Created",
-					"location": fmt.Sprintf("%s/%s", resource["resourceType"], resource["id"]),
-				},
-			},
-		},
-		"meta": map[string]interface{}{
-			"lastUpdated": time.Now().Format(time.RFC3339),
-		},
-		"link": []interface{}{
-			map[string]interface{}{
-				"relation": "self",
-				"url":      req.URL.String(),
-			},
-		},
+	response, err := GqlRequest(gqlStr, profile, req)
+	if err != nil {
+		SendError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		ctxLog.Error("Error reading response body:", "error", err)
+		SendError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	SendReadResult(w, responseBody, response.StatusCode, req)
+}
+
+// SendCreateResult writes the resource returned by the create mutation with
+// 201 Created and its Location
+func SendCreateResult(w http.ResponseWriter, body []byte, statusCode int, req *http.Request, resourceType string) {
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		SendError(w, "Invalid upstream response", http.StatusBadGateway)
+		return
 	}
 
-	// Remove empty values
-	removeEmpties(bundle)
+	if errors := parseGraphQLErrors(result["errors"]); len(errors) > 0 {
+		SendOperationOutcome(w, result, statusCode)
+		return
+	}
 
-	body, err = json.Marshal(bundle)
+	data, _ := result["data"].(map[string]interface{})
+	resource, _ := data[fmt.Sprintf("%sCreate", resourceType)].(map[string]interface{})
+	id, _ := resource["id"].(string)
+	if id == "" {
+		SendError(w, "Upstream did not return the created resource", http.StatusBadGateway)
+		return
+	}
+
+	removeEmpties(TenantFromRequest(req).Schema, resource)
+	rewriteReferences(resource, TenantFromRequest(req).UpstreamBase(), publicBase(req))
+
+	resourceBody, err := json.Marshal(resource)
 	if err != nil {
-		// Return original if we can't marshal
-		return body
+		SendError(w, "There was an error processing the request", http.StatusInternalServerError)
+		return
 	}
 
-	return body
+	location := fmt.Sprintf("%s/%s/%s", publicBase(req), resourceType, id)
+	if versionID := resourceVersion(resource); versionID != "" {
+		location += "/_history/" + versionID
+	}
+	w.Header().Set("Location", location)
+	writeFhir(w, http.StatusCreated, resourceBody)
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTP status for the error codes GraphQL servers commonly put in
+// extensions.code. RTG_UPSTREAM_ERROR_STATUS adds to and overrides these.
+var UPSTREAM_ERROR_STATUS = map[string]int{
+	"BAD_USER_INPUT":            http.StatusBadRequest,
+	"BAD_REQUEST":               http.StatusBadRequest,
+	"GRAPHQL_PARSE_FAILED":      http.StatusBadRequest,
+	"GRAPHQL_VALIDATION_FAILED": http.StatusBadRequest,
+	"UNAUTHENTICATED":           http.StatusUnauthorized,
+	"FORBIDDEN":                 http.StatusForbidden,
+	"NOT_FOUND":                 http.StatusNotFound,
+	"CONFLICT":                  http.StatusConflict,
+	"GONE":                      http.StatusGone,
+	"DELETED":                   http.StatusGone,
+	"RESOURCE_DELETED":          http.StatusGone,
+	"TOO_MANY_REQUESTS":         http.StatusTooManyRequests,
+	"RATE_LIMITED":              http.StatusTooManyRequests,
+	"INTERNAL_SERVER_ERROR":     http.StatusInternalServerError,
+	"NOT_IMPLEMENTED":           http.StatusNotImplemented,
+	"SERVICE_UNAVAILABLE":       http.StatusServiceUnavailable,
+	"TIMEOUT":                   http.StatusGatewayTimeout,
+}
+
+// FHIR IssueType for an HTTP status, exception for anything else
+var statusIssueTypes = map[int]string{
+	http.StatusBadRequest:           "invalid",
+	http.StatusUnauthorized:         "login",
+	http.StatusForbidden:            "forbidden",
+	http.StatusNotFound:             "not-found",
+	http.StatusMethodNotAllowed:     "not-supported",
+	http.StatusConflict:             "conflict",
+	http.StatusGone:                 "deleted",
+	http.StatusPreconditionFailed:   "conflict",
+	http.StatusUnsupportedMediaType: "not-supported",
+	http.StatusUnprocessableEntity:  "processing",
+	http.StatusTooManyRequests:      "throttled",
+	http.StatusNotImplemented:       "not-supported",
+	http.StatusGatewayTimeout:       "timeout",
+}
+
+// statusIssueType returns the FHIR IssueType for an HTTP status
+func statusIssueType(statusCode int) string {
+	if issueType, ok := statusIssueTypes[statusCode]; ok {
+		return issueType
+	}
+	return "exception"
+}
+
+var issueSeverities = []string{"fatal", "error", "warning", "information"}
+
+// parseUpstreamErrorStatus reads a list like NOT_FOUND=404,MY_CODE=409 into
+// UPSTREAM_ERROR_STATUS
+func parseUpstreamErrorStatus(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		code, status, found := strings.Cut(pair, "=")
+		statusCode, err := strconv.Atoi(strings.TrimSpace(status))
+		if !found || err != nil || statusCode < 400 || statusCode > 599 {
+			return fmt.Errorf("invalid upstream error status: %s", pair)
+		}
+		UPSTREAM_ERROR_STATUS[strings.ToUpper(strings.TrimSpace(code))] = statusCode
+	}
+	return nil
+}
+
+// graphQLError is an entry of the errors list of a GraphQL response
+type graphQLError struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path"`
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+func parseGraphQLErrors(errors interface{}) []graphQLError {
+	encoded, err := json.Marshal(errors)
+	if err != nil {
+		return nil
+	}
+	var parsed []graphQLError
+	if json.Unmarshal(encoded, &parsed) != nil {
+		return nil
+	}
+	return parsed
+}
+
+func (e graphQLError) code() string {
+	if e.Extensions == nil || e.Extensions["code"] == nil {
+		return ""
+	}
+	return strings.ToUpper(fmt.Sprint(e.Extensions["code"]))
+}
+
+// status returns the HTTP status for the error, 0 if its code is unknown
+func (e graphQLError) status() int {
+	code := e.code()
+	if status, exists := UPSTREAM_ERROR_STATUS[code]; exists {
+		return status
+	}
+	if status, err := strconv.Atoi(code); err == nil && status >= 400 && status < 600 {
+		return status
+	}
+	return 0
+}
+
+// expression turns the GraphQL path of the error into a FHIRPath, dropping
+// the connection edges and nodes. Patient.name[0] for
+// ["PatientConnection", "edges", 2, "node", "name", 0].
+func (e graphQLError) expression() string {
+	var expr strings.Builder
+	for i := 0; i < len(e.Path); i++ {
+		switch segment := e.Path[i].(type) {
+		case string:
+			if segment == "node" {
+				continue
+			}
+			if segment == "edges" {
+				// Skip the edge index as well
+				i++
+				continue
+			}
+			if expr.Len() == 0 {
+				segment = strings.TrimSuffix(segment, "Connection")
+			} else {
+				expr.WriteString(".")
+			}
+			expr.WriteString(segment)
+		case float64:
+			fmt.Fprintf(&expr, "[%d]", int(segment))
+		}
+	}
+	return expr.String()
+}
+
+// issue converts the error to an OperationOutcome issue. The severity comes
+// from extensions.severity if it is a FHIR severity.
+func (e graphQLError) issue(severity string) map[string]interface{} {
+	if s, _ := e.Extensions["severity"].(string); containsString(issueSeverities, strings.ToLower(s)) {
+		severity = strings.ToLower(s)
+	}
+	issueType := statusIssueType(e.status())
+
+	issue := map[string]interface{}{
+		"severity": severity,
+		"code":     issueType,
+		"details": map[string]interface{}{
+			"text": e.Message,
+		},
+	}
+	if code := e.code(); code != "" {
+		issue["diagnostics"] = "Upstream error code " + code
+	}
+	if expression := e.expression(); expression != "" {
+		issue["expression"] = []interface{}{expression}
+	}
+	return issue
+}
+
+// graphQLIssues converts each GraphQL error into an OperationOutcome issue
+func graphQLIssues(errors []graphQLError, severity string) []interface{} {
+	issues := make([]interface{}, 0, len(errors))
+	for _, e := range errors {
+		issues = append(issues, e.issue(severity))
+	}
+	return issues
+}
+
+// graphQLErrorStatus returns the HTTP status for a failed GraphQL response:
+// the highest status of its errors, or the upstream status if that is an
+// error itself. Unknown errors are reported as 500.
+func graphQLErrorStatus(errors []graphQLError, upstreamStatus int) int {
+	status := 0
+	for _, e := range errors {
+		if s := e.status(); s > status {
+			status = s
+		}
+	}
+	if status == 0 {
+		status = upstreamStatus
+	}
+	if status < 400 {
+		status = http.StatusInternalServerError
+	}
+	return status
+}
+
+// hasPartialData reports whether a GraphQL response with errors still
+// returned data for at least one field
+func hasPartialData(result map[string]interface{}) bool {
+	data, _ := result["data"].(map[string]interface{})
+	for _, v := range data {
+		if v != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func outcomeResource(issues []interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType": "OperationOutcome",
+		"issue":        issues,
+	}
+}
+
+// SendOperationOutcome reports the errors of a failed GraphQL response
+func SendOperationOutcome(w http.ResponseWriter, result map[string]interface{}, statusCode int) {
+	errors := parseGraphQLErrors(result["errors"])
+	if len(errors) == 0 {
+		SendError(w, "There was an error processing the request", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(outcomeResource(graphQLIssues(errors, "error")))
+	if err != nil {
+		SendError(w, "There was an error processing the request", http.StatusInternalServerError)
+		return
+	}
+	writeFhir(w, graphQLErrorStatus(errors, statusCode), body)
+}
@@ -33,7 +33,7 @@ func KebabToLowerCamel(s string) string {
 	return strings.Join(parts, "")
 }
 
-func parseIncludeParam(includeParam string) (IncludeParam, error) {
+func parseIncludeParam(schemaDict map[string]gql.SchemaType, includeParam string) (IncludeParam, error) {
 	parts := strings.Split(includeParam, ":")
 
 	if len(parts) != 2 && len(parts) != 3 {
@@ -60,7 +60,7 @@ func parseIncludeParam(includeParam string) (IncludeParam, error) {
 		include.PossibleTypes = append(include.PossibleTypes, possibleType.Name)
 	}
 
-	log.Debug(fmt.Sprintf("Include Resource: %v\n", unionType.PossibleTypes))
+	log.Debug("include resource", "possible_types", unionType.PossibleTypes)
 
 	return include, nil
 }
@@ -0,0 +1,957 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+// PATCH with JSON Patch (RFC 6902) or FHIRPath Patch, see
+// https://hl7.org/fhir/http.html#patch and https://hl7.org/fhir/fhirpatch.html
+
+const JSON_PATCH_CONTENT_TYPE = "application/json-patch+json"
+
+// patchError is a patch that is well-formed but cannot be applied to the
+// resource, reported as 422
+type patchError struct {
+	msg string
+}
+
+func (e *patchError) Error() string {
+	return e.msg
+}
+
+func patchErrorf(format string, args ...interface{}) error {
+	return &patchError{fmt.Sprintf(format, args...)}
+}
+
+func patchHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	LoggerFromRequest(req).Info("Patch Resource", "type", params.Type, "id", params.ID)
+	FhirPatch(w, req, params.Type, params.ID)
+}
+
+// FhirPatch reads the current resource, applies the patch and writes the
+// result back with the update mutation
+func FhirPatch(w http.ResponseWriter, req *http.Request, resourceType string, id string) {
+	ctxLog := LoggerFromRequest(req)
+	schema := TenantFromRequest(req).Schema
+	profile := req.URL.Query().Get("_profile")
+
+	if err := validateResourceID(id); err != nil {
+		SendIssue(w, "invalid", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		SendError(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	jsonPatch := mediaType == JSON_PATCH_CONTENT_TYPE
+	if !jsonPatch {
+		switch formatMimeTypes[mediaType] {
+		case FORMAT_JSON:
+		case FORMAT_XML:
+			body, err = fhirXMLToJSON(body, schema)
+			if err != nil {
+				SendError(w, "Invalid FHIR XML: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			SendError(w, "PATCH requires a JSON Patch or FHIRPath Patch Parameters body", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	resource, statusCode, err := readCurrentResource(req, resourceType, id, profile)
+	if err != nil {
+		sendReadError(w, err, statusCode)
+		return
+	}
+
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if versionID := resourceVersion(resource); parseETag(ifMatch) != versionID {
+			ctxLog.Info("Version conflict", "if_match", ifMatch, "version", versionID)
+			SendError(w, fmt.Sprintf("Version %s does not match current version %s", ifMatch, versionID), http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	var patched map[string]interface{}
+	if jsonPatch {
+		patched, err = applyJSONPatch(resource, body)
+	} else {
+		patched, err = applyFHIRPathPatch(schema, resource, body)
+	}
+	if err != nil {
+		if _, ok := err.(*patchError); ok {
+			SendError(w, err.Error(), http.StatusUnprocessableEntity)
+		} else {
+			SendError(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	if patched["resourceType"] != resourceType || patched["id"] != id {
+		SendError(w, "PATCH must not change resourceType or id", http.StatusUnprocessableEntity)
+		return
+	}
+
+	gqlStr, err := generateUpdateMutation(schema, resourceType, id, patched)
+	if err != nil {
+		SendError(w, "Failed to generate GraphQL mutation", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := GqlRequest(gqlStr, profile, req)
+	if err != nil {
+		SendError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		ctxLog.Error("Error reading response body:", "error", err)
+		SendError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	SendReadResult(w, responseBody, response.StatusCode, req)
+}
+
+// readCurrentResource runs the read query for a resource. On failure the
+// HTTP status to report is returned with the error.
+func readCurrentResource(req *http.Request, resourceType string, id string, profile string) (map[string]interface{}, int, error) {
+	gqlStr := ReadRequest(TenantFromRequest(req).Schema, resourceType, id)
+
+	response, err := GqlRequest(gqlStr, profile, req)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	defer response.Body.Close()
+
+	var result map[string]interface{}
+	decoder := json.NewDecoder(response.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("invalid upstream response")
+	}
+	if resourceGone(result, response.StatusCode) {
+		return nil, http.StatusGone, fmt.Errorf("%s/%s has been deleted", resourceType, id)
+	}
+	if errors := parseGraphQLErrors(result["errors"]); len(errors) > 0 {
+		return nil, graphQLErrorStatus(errors, http.StatusBadGateway), fmt.Errorf("%s", errors[0].Message)
+	}
+	data, _ := result["data"].(map[string]interface{})
+	resource, _ := data[resourceType].(map[string]interface{})
+	if resource == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("%s/%s not found", resourceType, id)
+	}
+	removeEmpties(TenantFromRequest(req).Schema, resource)
+	return resource, http.StatusOK, nil
+}
+
+// sendReadError reports a failed readCurrentResource
+func sendReadError(w http.ResponseWriter, err error, statusCode int) {
+	switch statusCode {
+	case http.StatusNotFound:
+		SendIssue(w, "not-found", err.Error(), statusCode)
+	case http.StatusGone:
+		SendIssue(w, "deleted", err.Error(), statusCode)
+	default:
+		SendError(w, err.Error(), statusCode)
+	}
+}
+
+// resourceVersion returns the meta.versionId of a resource, or "" without one
+func resourceVersion(resource map[string]interface{}) string {
+	meta, _ := resource["meta"].(map[string]interface{})
+	versionID, _ := meta["versionId"].(string)
+	return versionID
+}
+
+// unmarshalJSONNumbers decodes JSON keeping numbers as json.Number, so the
+// decimals of a patched resource keep their precision
+func unmarshalJSONNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// jsonEqual compares decoded JSON values, numbers by their value
+func jsonEqual(a interface{}, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, xOk := new(big.Rat).SetString(a.String())
+		y, yOk := new(big.Rat).SetString(b.String())
+		return xOk && yOk && x.Cmp(y) == 0
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, exists := b[key]
+			if !exists || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// parseETag strips the weak prefix and quotes from an ETag like W/"3"
+func parseETag(etag string) string {
+	etag = strings.TrimSpace(etag)
+	etag = strings.TrimPrefix(etag, "W/")
+	return strings.Trim(etag, `"`)
+}
+
+// JSON Patch
+
+type jsonPatchOperation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+func applyJSONPatch(resource map[string]interface{}, body []byte) (map[string]interface{}, error) {
+	var operations []jsonPatchOperation
+	if err := json.Unmarshal(body, &operations); err != nil {
+		return nil, fmt.Errorf("invalid JSON Patch document: %s", err)
+	}
+
+	var doc interface{} = resource
+	for i, operation := range operations {
+		if operation.Path == nil {
+			return nil, fmt.Errorf("operation %d has no path", i)
+		}
+		path, err := parseJSONPointer(*operation.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		switch operation.Op {
+		case "add", "replace", "test":
+			if operation.Value == nil {
+				return nil, fmt.Errorf("operation %d (%s) has no value", i, operation.Op)
+			}
+			if err := unmarshalJSONNumbers(*operation.Value, &value); err != nil {
+				return nil, fmt.Errorf("operation %d has an invalid value", i)
+			}
+		case "move", "copy":
+			if operation.From == nil {
+				return nil, fmt.Errorf("operation %d (%s) has no from", i, operation.Op)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("unknown JSON Patch operation: %s", operation.Op)
+		}
+
+		switch operation.Op {
+		case "add":
+			doc, err = pointerAdd(doc, path, value)
+		case "remove":
+			doc, err = pointerRemove(doc, path)
+		case "replace":
+			doc, err = pointerReplace(doc, path, value)
+		case "test":
+			var current interface{}
+			current, err = pointerGet(doc, path)
+			if err == nil && !jsonEqual(current, value) {
+				err = patchErrorf("test failed at %s", *operation.Path)
+			}
+		case "move", "copy":
+			var from []string
+			from, err = parseJSONPointer(*operation.From)
+			if err != nil {
+				return nil, err
+			}
+			if operation.Op == "move" && len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+				return nil, patchErrorf("cannot move %s into itself", *operation.From)
+			}
+			value, err = pointerGet(doc, from)
+			if err != nil {
+				break
+			}
+			if operation.Op == "move" {
+				doc, err = pointerRemove(doc, from)
+			} else {
+				value, err = deepCopy(value)
+			}
+			if err == nil {
+				doc, err = pointerAdd(doc, path, value)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	patched, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, patchErrorf("patch result is not a resource")
+	}
+	return patched, nil
+}
+
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer: %s", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses a JSON pointer array index, allowing the index one past
+// the end if allowEnd is set
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, patchErrorf("invalid array index: %s", token)
+	}
+	if index > length || (index == length && !allowEnd) {
+		return 0, patchErrorf("array index out of bounds: %s", token)
+	}
+	return index, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, exists := node[token]
+			if !exists {
+				return nil, patchErrorf("path not found: %s", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, patchErrorf("path not found: %s", token)
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate walks to the parent of path and replaces it with the result
+// of update
+func pointerUpdate(doc interface{}, path []string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(doc, path[0])
+	}
+	token := path[0]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, exists := node[token]
+		if !exists {
+			return nil, patchErrorf("path not found: %s", token)
+		}
+		child, err := pointerUpdate(child, path[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[token] = child
+		return node, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := pointerUpdate(node[index], path[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = child
+		return node, nil
+	}
+	return nil, patchErrorf("path not found: %s", token)
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		return nil, patchErrorf("cannot add %s to a primitive value", token)
+	})
+}
+
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, patchErrorf("cannot remove the resource")
+	}
+	return pointerUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, exists := node[token]; !exists {
+				return nil, patchErrorf("path not found: %s", token)
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:index], node[index+1:]...), nil
+		}
+		return nil, patchErrorf("path not found: %s", token)
+	})
+}
+
+func pointerReplace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, exists := node[token]; !exists {
+				return nil, patchErrorf("path not found: %s", token)
+			}
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			node[index] = value
+			return node, nil
+		}
+		return nil, patchErrorf("path not found: %s", token)
+	})
+}
+
+func deepCopy(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var copied interface{}
+	err = unmarshalJSONNumbers(data, &copied)
+	return copied, err
+}
+
+// FHIRPath Patch
+
+// fhirPathNode is an element selected by a FHIRPath expression: parent[key],
+// or item index of the list at parent[key]
+type fhirPathNode struct {
+	parent     map[string]interface{}
+	key        string
+	index      int
+	schemaType string
+}
+
+func (n fhirPathNode) value() interface{} {
+	value := n.parent[n.key]
+	if n.index >= 0 {
+		return value.([]interface{})[n.index]
+	}
+	return value
+}
+
+func (n fhirPathNode) set(value interface{}) {
+	if n.index >= 0 {
+		n.parent[n.key].([]interface{})[n.index] = value
+		return
+	}
+	n.parent[n.key] = value
+}
+
+func (n fhirPathNode) remove() {
+	if n.index >= 0 {
+		list := n.parent[n.key].([]interface{})
+		list = append(list[:n.index], list[n.index+1:]...)
+		if len(list) > 0 {
+			n.parent[n.key] = list
+			return
+		}
+	}
+	delete(n.parent, n.key)
+}
+
+type fhirPathOperation struct {
+	Type        string
+	Path        string
+	Name        string
+	Value       interface{}
+	HasValue    bool
+	Index       int
+	Source      int
+	Destination int
+}
+
+func applyFHIRPathPatch(schemaDict map[string]gql.SchemaType, resource map[string]interface{}, body []byte) (map[string]interface{}, error) {
+	operations, err := parseFHIRPathPatch(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The root node is the only one with an empty key
+	resourceType, _ := resource["resourceType"].(string)
+	holder := map[string]interface{}{"": resource}
+	root := fhirPathNode{parent: holder, key: "", index: -1, schemaType: resourceType}
+
+	for _, operation := range operations {
+		if err := applyFHIRPathOperation(schemaDict, root, operation); err != nil {
+			return nil, err
+		}
+	}
+	return resource, nil
+}
+
+func parseFHIRPathPatch(body []byte) ([]fhirPathOperation, error) {
+	var parameters struct {
+		ResourceType string `json:"resourceType"`
+		Parameter    []struct {
+			Name string                   `json:"name"`
+			Part []map[string]interface{} `json:"part"`
+		} `json:"parameter"`
+	}
+	if err := unmarshalJSONNumbers(body, &parameters); err != nil || parameters.ResourceType != "Parameters" {
+		return nil, fmt.Errorf("FHIRPath Patch body must be a Parameters resource")
+	}
+
+	var operations []fhirPathOperation
+	for _, parameter := range parameters.Parameter {
+		if parameter.Name != "operation" {
+			continue
+		}
+		operation := fhirPathOperation{Index: -1, Source: -1, Destination: -1}
+		for _, part := range parameter.Part {
+			name, _ := part["name"].(string)
+			value, hasValue := fhirPathPatchValue(part)
+			switch name {
+			case "type":
+				operation.Type, _ = value.(string)
+			case "path":
+				operation.Path, _ = value.(string)
+			case "name":
+				operation.Name, _ = value.(string)
+			case "value":
+				operation.Value, operation.HasValue = value, hasValue
+			case "index", "source", "destination":
+				number, _ := value.(json.Number)
+				index, err := strconv.Atoi(number.String())
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("FHIRPath Patch %s must be a non-negative integer", name)
+				}
+				switch name {
+				case "index":
+					operation.Index = index
+				case "source":
+					operation.Source = index
+				default:
+					operation.Destination = index
+				}
+			}
+		}
+		if operation.Path == "" {
+			return nil, fmt.Errorf("FHIRPath Patch operation without path")
+		}
+		operations = append(operations, operation)
+	}
+	if len(operations) == 0 {
+		return nil, fmt.Errorf("FHIRPath Patch has no operations")
+	}
+	return operations, nil
+}
+
+// fhirPathPatchValue returns the value[x] of a Parameters part, or an object
+// built from its nested parts
+func fhirPathPatchValue(part map[string]interface{}) (interface{}, bool) {
+	for key, value := range part {
+		if strings.HasPrefix(key, "value") {
+			return value, true
+		}
+	}
+	subParts, ok := part["part"].([]interface{})
+	if !ok {
+		return nil, false
+	}
+	object := make(map[string]interface{})
+	for _, subPart := range subParts {
+		subMap, ok := subPart.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := subMap["name"].(string)
+		value, hasValue := fhirPathPatchValue(subMap)
+		if name == "" || !hasValue {
+			continue
+		}
+		switch existing := object[name].(type) {
+		case nil:
+			object[name] = value
+		case []interface{}:
+			object[name] = append(existing, value)
+		default:
+			object[name] = []interface{}{existing, value}
+		}
+	}
+	return object, true
+}
+
+func applyFHIRPathOperation(schemaDict map[string]gql.SchemaType, root fhirPathNode, operation fhirPathOperation) error {
+	switch operation.Type {
+	case "add":
+		if operation.Name == "" || !operation.HasValue {
+			return fmt.Errorf("FHIRPath Patch add requires name and value")
+		}
+		container, err := singleFHIRPathNode(schemaDict, root, operation.Path)
+		if err != nil {
+			return err
+		}
+		element, ok := container.value().(map[string]interface{})
+		if !ok {
+			return patchErrorf("cannot add %s to %s", operation.Name, operation.Path)
+		}
+		field, isKnown := schemaField(schemaDict, container.schemaType, operation.Name)
+		switch existing := element[operation.Name].(type) {
+		case nil:
+			if isKnown && field.List {
+				element[operation.Name] = []interface{}{operation.Value}
+			} else {
+				element[operation.Name] = operation.Value
+			}
+		case []interface{}:
+			element[operation.Name] = append(existing, operation.Value)
+		default:
+			return patchErrorf("%s.%s already has a value", operation.Path, operation.Name)
+		}
+
+	case "insert", "move":
+		parentPath, name := splitLastFHIRPathSegment(operation.Path)
+		if parentPath == "" || !isFHIRPathName(name) {
+			return patchErrorf("invalid list path: %s", operation.Path)
+		}
+		container, err := singleFHIRPathNode(schemaDict, root, parentPath)
+		if err != nil {
+			return err
+		}
+		element, ok := container.value().(map[string]interface{})
+		if !ok {
+			return patchErrorf("path not found: %s", operation.Path)
+		}
+		list, _ := element[name].([]interface{})
+		if element[name] != nil && list == nil {
+			return patchErrorf("%s is not a list", operation.Path)
+		}
+
+		if operation.Type == "insert" {
+			if !operation.HasValue || operation.Index < 0 {
+				return fmt.Errorf("FHIRPath Patch insert requires index and value")
+			}
+			if operation.Index > len(list) {
+				return patchErrorf("index %d out of bounds for %s", operation.Index, operation.Path)
+			}
+			list = append(list, nil)
+			copy(list[operation.Index+1:], list[operation.Index:])
+			list[operation.Index] = operation.Value
+		} else {
+			if operation.Source < 0 || operation.Destination < 0 {
+				return fmt.Errorf("FHIRPath Patch move requires source and destination")
+			}
+			if operation.Source >= len(list) || operation.Destination >= len(list) {
+				return patchErrorf("index out of bounds for %s", operation.Path)
+			}
+			item := list[operation.Source]
+			list = append(list[:operation.Source], list[operation.Source+1:]...)
+			list = append(list[:operation.Destination], append([]interface{}{item}, list[operation.Destination:]...)...)
+		}
+		element[name] = list
+
+	case "replace":
+		if !operation.HasValue {
+			return fmt.Errorf("FHIRPath Patch replace requires a value")
+		}
+		node, err := singleFHIRPathNode(schemaDict, root, operation.Path)
+		if err != nil {
+			return err
+		}
+		if node.key == "" {
+			return patchErrorf("cannot replace the resource")
+		}
+		node.set(operation.Value)
+
+	case "delete":
+		nodes, err := evalFHIRPath(schemaDict, root, operation.Path)
+		if err != nil {
+			return err
+		}
+		if len(nodes) > 1 {
+			return patchErrorf("%s matches more than one element", operation.Path)
+		}
+		if len(nodes) == 1 {
+			if nodes[0].key == "" {
+				return patchErrorf("cannot delete the resource")
+			}
+			nodes[0].remove()
+		}
+
+	default:
+		return fmt.Errorf("unknown FHIRPath Patch operation type: %q", operation.Type)
+	}
+	return nil
+}
+
+func singleFHIRPathNode(schemaDict map[string]gql.SchemaType, root fhirPathNode, path string) (fhirPathNode, error) {
+	nodes, err := evalFHIRPath(schemaDict, root, path)
+	if err != nil {
+		return fhirPathNode{}, err
+	}
+	if len(nodes) != 1 {
+		return fhirPathNode{}, patchErrorf("%s matches %d elements, expected one", path, len(nodes))
+	}
+	return nodes[0], nil
+}
+
+// splitFHIRPath splits an expression on the dots outside of function
+// arguments and string literals
+func splitFHIRPath(path string) ([]string, error) {
+	var segments []string
+	depth := 0
+	quoted := false
+	start := 0
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\'' && (i == 0 || path[i-1] != '\\'):
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '.' && depth == 0:
+			segments = append(segments, strings.TrimSpace(path[start:i]))
+			start = i + 1
+		}
+	}
+	if depth != 0 || quoted {
+		return nil, patchErrorf("invalid FHIRPath: %s", path)
+	}
+	segments = append(segments, strings.TrimSpace(path[start:]))
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, patchErrorf("invalid FHIRPath: %s", path)
+		}
+	}
+	return segments, nil
+}
+
+func splitLastFHIRPathSegment(path string) (string, string) {
+	segments, err := splitFHIRPath(path)
+	if err != nil || len(segments) < 2 {
+		return "", ""
+	}
+	return strings.Join(segments[:len(segments)-1], "."), segments[len(segments)-1]
+}
+
+func isFHIRPathName(segment string) bool {
+	for i, c := range segment {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return segment != ""
+}
+
+// evalFHIRPath evaluates the subset of FHIRPath used to address elements in
+// patches: element names, [n] indexers, first(), last() and where() with a
+// single equality
+func evalFHIRPath(schemaDict map[string]gql.SchemaType, root fhirPathNode, path string) ([]fhirPathNode, error) {
+	segments, err := splitFHIRPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if segments[0] == root.schemaType {
+		segments = segments[1:]
+	} else if c := segments[0][0]; c >= 'A' && c <= 'Z' && isFHIRPathName(segments[0]) {
+		return nil, patchErrorf("%s does not apply to %s", path, root.schemaType)
+	}
+	return evalFHIRPathSegments(schemaDict, []fhirPathNode{root}, segments)
+}
+
+func evalFHIRPathSegments(schemaDict map[string]gql.SchemaType, nodes []fhirPathNode, segments []string) ([]fhirPathNode, error) {
+	for _, segment := range segments {
+		segment, index, err := splitFHIRPathIndexer(segment)
+		if err != nil {
+			return nil, err
+		}
+
+		name, rest, isFunction := strings.Cut(segment, "(")
+		if isFunction {
+			arguments, closed := strings.CutSuffix(rest, ")")
+			if !closed {
+				return nil, patchErrorf("invalid FHIRPath function: %s", segment)
+			}
+			switch name {
+			case "first":
+				if len(nodes) > 1 {
+					nodes = nodes[:1]
+				}
+			case "last":
+				if len(nodes) > 1 {
+					nodes = nodes[len(nodes)-1:]
+				}
+			case "where":
+				filtered, err := whereFHIRPath(schemaDict, nodes, arguments)
+				if err != nil {
+					return nil, err
+				}
+				nodes = filtered
+			default:
+				return nil, patchErrorf("unsupported FHIRPath function: %s()", name)
+			}
+			nodes = indexFHIRPathNodes(nodes, index)
+			continue
+		}
+
+		if !isFHIRPathName(segment) {
+			return nil, patchErrorf("invalid FHIRPath element: %s", segment)
+		}
+
+		var children []fhirPathNode
+		for _, node := range nodes {
+			element, ok := node.value().(map[string]interface{})
+			if !ok {
+				continue
+			}
+			field, _ := schemaField(schemaDict, node.schemaType, segment)
+			switch value := element[segment].(type) {
+			case nil:
+			case []interface{}:
+				for i := range value {
+					children = append(children, fhirPathNode{element, segment, i, field.Type})
+				}
+			default:
+				children = append(children, fhirPathNode{element, segment, -1, field.Type})
+			}
+		}
+		nodes = indexFHIRPathNodes(children, index)
+	}
+	return nodes, nil
+}
+
+// splitFHIRPathIndexer splits a trailing [n] indexer off a path segment, like
+// name[0] or where(system='x')[0]. The index is -1 without one.
+func splitFHIRPathIndexer(segment string) (string, int, error) {
+	open := strings.LastIndex(segment, "[")
+	if open < 0 || open < strings.LastIndex(segment, ")") {
+		return segment, -1, nil
+	}
+	if !strings.HasSuffix(segment, "]") {
+		return "", 0, patchErrorf("invalid FHIRPath indexer: %s", segment)
+	}
+	index, err := strconv.Atoi(segment[open+1 : len(segment)-1])
+	if err != nil || index < 0 {
+		return "", 0, patchErrorf("invalid FHIRPath indexer: %s", segment)
+	}
+	return segment[:open], index, nil
+}
+
+// indexFHIRPathNodes applies an indexer to a collection, -1 keeps all nodes
+func indexFHIRPathNodes(nodes []fhirPathNode, index int) []fhirPathNode {
+	if index < 0 {
+		return nodes
+	}
+	if index < len(nodes) {
+		return nodes[index : index+1]
+	}
+	return nil
+}
+
+// whereFHIRPath keeps the nodes for which a criteria like system='x' holds
+func whereFHIRPath(schemaDict map[string]gql.SchemaType, nodes []fhirPathNode, criteria string) ([]fhirPathNode, error) {
+	left, right, found := strings.Cut(criteria, "=")
+	if !found || strings.HasSuffix(left, "!") {
+		return nil, patchErrorf("unsupported where() criteria: %s", criteria)
+	}
+	segments, err := splitFHIRPath(strings.TrimSpace(left))
+	if err != nil {
+		return nil, err
+	}
+	literal := strings.TrimSpace(right)
+	if strings.HasPrefix(literal, "'") && strings.HasSuffix(literal, "'") && len(literal) >= 2 {
+		literal = strings.ReplaceAll(literal[1:len(literal)-1], `\'`, "'")
+	}
+
+	var filtered []fhirPathNode
+	for _, node := range nodes {
+		matches, err := evalFHIRPathSegments(schemaDict, []fhirPathNode{node}, segments)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if fmt.Sprint(match.value()) == literal {
+				filtered = append(filtered, node)
+				break
+			}
+		}
+	}
+	return filtered, nil
+}
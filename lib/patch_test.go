@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+var patchSchema = map[string]gql.SchemaType{
+	"Patient": {Name: "Patient", Fields: []gql.Field{
+		{Name: "identifier", Type: "Identifier", List: true},
+		{Name: "name", Type: "HumanName", List: true},
+		{Name: "birthDate", Type: "String"},
+	}},
+	"Identifier": {Name: "Identifier", Fields: []gql.Field{
+		{Name: "system", Type: "String"},
+		{Name: "value", Type: "String"},
+	}},
+	"HumanName": {Name: "HumanName", Fields: []gql.Field{
+		{Name: "family", Type: "String"},
+		{Name: "given", Type: "String", List: true},
+	}},
+}
+
+const patchPatient = `{"resourceType":"Patient","id":"1","name":[{"family":"A","given":["B","C"]}],"identifier":[{"system":"x","value":"1"},{"system":"y","value":"2"},{"system":"x","value":"3"}],"extension":[{"url":"weight","valueDecimal":1.50},{"url":"big","valueInteger64":9007199254740993}]}`
+
+func decodePatchJSON(t *testing.T, value string) map[string]interface{} {
+	t.Helper()
+	var decoded map[string]interface{}
+	if err := unmarshalJSONNumbers([]byte(value), &decoded); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", value, err)
+	}
+	return decoded
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		patch  string
+		expect string // Replaces the patched elements of patchPatient
+		err    string
+	}{
+		{
+			name:   "add to the end with -",
+			patch:  `[{"op":"add","path":"/name/0/given/-","value":"D"}]`,
+			expect: `{"name":[{"family":"A","given":["B","C","D"]}]}`,
+		},
+		{
+			name:   "add at the end index",
+			patch:  `[{"op":"add","path":"/name/0/given/2","value":"D"}]`,
+			expect: `{"name":[{"family":"A","given":["B","C","D"]}]}`,
+		},
+		{
+			name:   "add at the start",
+			patch:  `[{"op":"add","path":"/name/0/given/0","value":"D"}]`,
+			expect: `{"name":[{"family":"A","given":["D","B","C"]}]}`,
+		},
+		{
+			name:  "add past the end",
+			patch: `[{"op":"add","path":"/name/0/given/3","value":"D"}]`,
+			err:   "array index out of bounds: 3",
+		},
+		{
+			name:  "add with a leading zero index",
+			patch: `[{"op":"add","path":"/name/0/given/01","value":"D"}]`,
+			err:   "invalid array index: 01",
+		},
+		{
+			name:   "add an element",
+			patch:  `[{"op":"add","path":"/birthDate","value":"2000-01-01"}]`,
+			expect: `{"birthDate":"2000-01-01"}`,
+		},
+		{
+			name:   "remove the last item",
+			patch:  `[{"op":"remove","path":"/name/0/given/1"}]`,
+			expect: `{"name":[{"family":"A","given":["B"]}]}`,
+		},
+		{
+			name:  "remove past the end",
+			patch: `[{"op":"remove","path":"/name/0/given/2"}]`,
+			err:   "array index out of bounds: 2",
+		},
+		{
+			name:  "remove with -",
+			patch: `[{"op":"remove","path":"/name/0/given/-"}]`,
+			err:   "invalid array index: -",
+		},
+		{
+			name:   "replace the last item",
+			patch:  `[{"op":"replace","path":"/name/0/given/1","value":"D"}]`,
+			expect: `{"name":[{"family":"A","given":["B","D"]}]}`,
+		},
+		{
+			name:  "replace with -",
+			patch: `[{"op":"replace","path":"/name/0/given/-","value":"D"}]`,
+			err:   "invalid array index: -",
+		},
+		{
+			name:  "replace a missing element",
+			patch: `[{"op":"replace","path":"/birthDate","value":"2000-01-01"}]`,
+			err:   "path not found: birthDate",
+		},
+		{
+			name:   "test passes",
+			patch:  `[{"op":"test","path":"/name/0/family","value":"A"},{"op":"replace","path":"/name/0/family","value":"Z"}]`,
+			expect: `{"name":[{"family":"Z","given":["B","C"]}]}`,
+		},
+		{
+			name:   "test compares numbers by value",
+			patch:  `[{"op":"test","path":"/extension/0/valueDecimal","value":1.5}]`,
+			expect: `{}`,
+		},
+		{
+			name:  "test fails",
+			patch: `[{"op":"test","path":"/name/0/family","value":"Z"},{"op":"replace","path":"/name/0/family","value":"Z"}]`,
+			err:   "test failed at /name/0/family",
+		},
+		{
+			name:  "test of a missing element",
+			patch: `[{"op":"test","path":"/birthDate","value":"2000-01-01"}]`,
+			err:   "path not found: birthDate",
+		},
+		{
+			name:   "move",
+			patch:  `[{"op":"move","from":"/name/0/given/1","path":"/name/0/given/0"}]`,
+			expect: `{"name":[{"family":"A","given":["C","B"]}]}`,
+		},
+		{
+			name:  "move into itself",
+			patch: `[{"op":"move","from":"/name/0","path":"/name/0/given/0"}]`,
+			err:   "cannot move /name/0 into itself",
+		},
+		{
+			name:   "copy is independent of its source",
+			patch:  `[{"op":"copy","from":"/name/0","path":"/name/-"},{"op":"replace","path":"/name/1/family","value":"Z"}]`,
+			expect: `{"name":[{"family":"A","given":["B","C"]},{"family":"Z","given":["B","C"]}]}`,
+		},
+		{
+			name:  "copy from a missing element",
+			patch: `[{"op":"copy","from":"/birthDate","path":"/name/0/family"}]`,
+			err:   "path not found: birthDate",
+		},
+		{
+			name:   "escaped pointer tokens",
+			patch:  `[{"op":"add","path":"/a~1b~0c","value":"d"}]`,
+			expect: `{"a/b~c":"d"}`,
+		},
+		{
+			name:   "decimal values keep their precision",
+			patch:  `[{"op":"add","path":"/extension/-","value":{"url":"height","valueDecimal":1.80}}]`,
+			expect: `{"extension":[{"url":"weight","valueDecimal":1.50},{"url":"big","valueInteger64":9007199254740993},{"url":"height","valueDecimal":1.80}]}`,
+		},
+		{
+			name:  "unknown operation",
+			patch: `[{"op":"merge","path":"/name"}]`,
+			err:   "unknown JSON Patch operation: merge",
+		},
+		{
+			name:  "operation without a value",
+			patch: `[{"op":"add","path":"/birthDate"}]`,
+			err:   "operation 0 (add) has no value",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patched, err := applyJSONPatch(decodePatchJSON(t, patchPatient), []byte(test.patch))
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, expected %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expect := decodePatchJSON(t, patchPatient)
+			for key, value := range decodePatchJSON(t, test.expect) {
+				expect[key] = value
+			}
+			if !reflect.DeepEqual(patched, expect) {
+				got, _ := json.Marshal(patched)
+				t.Errorf("got %s", got)
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatchKeepsNumbers(t *testing.T) {
+	patched, err := applyJSONPatch(decodePatchJSON(t, patchPatient), []byte(`[{"op":"replace","path":"/name/0/family","value":"Z"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := json.Marshal(patched["extension"])
+	if expect := `[{"url":"weight","valueDecimal":1.50},{"url":"big","valueInteger64":9007199254740993}]`; string(encoded) != expect {
+		t.Errorf("got %s, expected %s", encoded, expect)
+	}
+}
+
+func TestTestFailureIsPatchError(t *testing.T) {
+	_, err := applyJSONPatch(decodePatchJSON(t, patchPatient), []byte(`[{"op":"test","path":"/id","value":"2"}]`))
+	if _, ok := err.(*patchError); !ok {
+		t.Errorf("got %T, expected *patchError", err)
+	}
+}
+
+// fhirPathPatch builds a FHIRPath Patch Parameters body with one operation
+func fhirPathPatch(parts ...string) string {
+	return `{"resourceType":"Parameters","parameter":[{"name":"operation","part":[` + strings.Join(parts, ",") + `]}]}`
+}
+
+func TestParseFHIRPathPatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		expect fhirPathOperation
+		err    string
+	}{
+		{
+			name:   "insert",
+			body:   fhirPathPatch(`{"name":"type","valueCode":"insert"}`, `{"name":"path","valueString":"Patient.name"}`, `{"name":"index","valueInteger":1}`, `{"name":"value","valueHumanName":{"family":"Z"}}`),
+			expect: fhirPathOperation{Type: "insert", Path: "Patient.name", Index: 1, Source: -1, Destination: -1, HasValue: true, Value: map[string]interface{}{"family": "Z"}},
+		},
+		{
+			name:   "move",
+			body:   fhirPathPatch(`{"name":"type","valueCode":"move"}`, `{"name":"path","valueString":"Patient.name"}`, `{"name":"source","valueInteger":0}`, `{"name":"destination","valueInteger":2}`),
+			expect: fhirPathOperation{Type: "move", Path: "Patient.name", Index: -1, Source: 0, Destination: 2},
+		},
+		{
+			name:   "value built from parts",
+			body:   fhirPathPatch(`{"name":"type","valueCode":"add"}`, `{"name":"path","valueString":"Patient"}`, `{"name":"name","valueString":"identifier"}`, `{"name":"value","part":[{"name":"system","valueUri":"x"},{"name":"value","valueString":"9"}]}`),
+			expect: fhirPathOperation{Type: "add", Path: "Patient", Name: "identifier", Index: -1, Source: -1, Destination: -1, HasValue: true, Value: map[string]interface{}{"system": "x", "value": "9"}},
+		},
+		{
+			name:   "decimal value keeps its precision",
+			body:   fhirPathPatch(`{"name":"type","valueCode":"replace"}`, `{"name":"path","valueString":"Observation.valueQuantity.value"}`, `{"name":"value","valueDecimal":1.50}`),
+			expect: fhirPathOperation{Type: "replace", Path: "Observation.valueQuantity.value", Index: -1, Source: -1, Destination: -1, HasValue: true, Value: json.Number("1.50")},
+		},
+		{
+			name: "fractional index",
+			body: fhirPathPatch(`{"name":"type","valueCode":"insert"}`, `{"name":"path","valueString":"Patient.name"}`, `{"name":"index","valueDecimal":1.5}`),
+			err:  "FHIRPath Patch index must be a non-negative integer",
+		},
+		{
+			name: "negative index",
+			body: fhirPathPatch(`{"name":"type","valueCode":"insert"}`, `{"name":"path","valueString":"Patient.name"}`, `{"name":"index","valueInteger":-1}`),
+			err:  "FHIRPath Patch index must be a non-negative integer",
+		},
+		{
+			name: "operation without path",
+			body: fhirPathPatch(`{"name":"type","valueCode":"delete"}`),
+			err:  "FHIRPath Patch operation without path",
+		},
+		{
+			name: "no operations",
+			body: `{"resourceType":"Parameters"}`,
+			err:  "FHIRPath Patch has no operations",
+		},
+		{
+			name: "not a Parameters resource",
+			body: `{"resourceType":"Patient"}`,
+			err:  "FHIRPath Patch body must be a Parameters resource",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			operations, err := parseFHIRPathPatch([]byte(test.body))
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, expected %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(operations) != 1 || !reflect.DeepEqual(operations[0], test.expect) {
+				t.Errorf("got %#v, expected %#v", operations, test.expect)
+			}
+		})
+	}
+}
+
+func TestEvalFHIRPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		expect []string // Values of the identifiers or names found
+		err    string
+	}{
+		{path: "Patient.identifier", expect: []string{"1", "2", "3"}},
+		{path: "identifier", expect: []string{"1", "2", "3"}},
+		{path: "Patient.identifier[1]", expect: []string{"2"}},
+		{path: "Patient.identifier[3]", expect: nil},
+		{path: "Patient.identifier.first()", expect: []string{"1"}},
+		{path: "Patient.identifier.last()", expect: []string{"3"}},
+		{path: "Patient.identifier.where(system='x')", expect: []string{"1", "3"}},
+		{path: "Patient.identifier.where(system = 'y')", expect: []string{"2"}},
+		{path: "Patient.identifier.where(system='x')[1]", expect: []string{"3"}},
+		{path: "Patient.identifier.where(system='x').first()", expect: []string{"1"}},
+		{path: "Patient.identifier.where(system='z')", expect: nil},
+		{path: "Patient.identifier.where(value='a.b[0]')", expect: nil},
+		{path: "Patient.name.given[1]", expect: []string{"C"}},
+		{path: "Observation.status", err: "Observation.status does not apply to Patient"},
+		{path: "Patient.identifier.exists()", err: "unsupported FHIRPath function: exists()"},
+		{path: "Patient.identifier.where(system!='x')", err: "unsupported where() criteria: system!='x'"},
+		{path: "Patient.identifier[x]", err: "invalid FHIRPath indexer: identifier[x]"},
+		{path: "Patient.identifier[0", err: "invalid FHIRPath indexer: identifier[0"},
+		{path: "Patient..identifier", err: "invalid FHIRPath: Patient..identifier"},
+		{path: "Patient.identifier.where(system='x'", err: "invalid FHIRPath: Patient.identifier.where(system='x'"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			resource := decodePatchJSON(t, patchPatient)
+			root := fhirPathNode{parent: map[string]interface{}{"": resource}, key: "", index: -1, schemaType: "Patient"}
+			nodes, err := evalFHIRPath(patchSchema, root, test.path)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, expected %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var values []string
+			for _, node := range nodes {
+				switch value := node.value().(type) {
+				case map[string]interface{}:
+					values = append(values, value["value"].(string))
+				case string:
+					values = append(values, value)
+				}
+			}
+			if !reflect.DeepEqual(values, test.expect) {
+				t.Errorf("got %v, expected %v", values, test.expect)
+			}
+		})
+	}
+}
+
+func TestApplyFHIRPathPatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		parts  []string
+		expect string // Replaces the patched elements of patchPatient
+		err    string
+	}{
+		{
+			name:   "insert at the end",
+			parts:  []string{`{"name":"type","valueCode":"insert"}`, `{"name":"path","valueString":"Patient.name.given"}`, `{"name":"index","valueInteger":2}`, `{"name":"value","valueString":"D"}`},
+			expect: `{"name":[{"family":"A","given":["B","C","D"]}]}`,
+		},
+		{
+			name:   "insert at the start",
+			parts:  []string{`{"name":"type","valueCode":"insert"}`, `{"name":"path","valueString":"Patient.name.given"}`, `{"name":"index","valueInteger":0}`, `{"name":"value","valueString":"D"}`},
+			expect: `{"name":[{"family":"A","given":["D","B","C"]}]}`,
+		},
+		{
+			name:  "insert past the end",
+			parts: []string{`{"name":"type","valueCode":"insert"}`, `{"name":"path","valueString":"Patient.name.given"}`, `{"name":"index","valueInteger":3}`, `{"name":"value","valueString":"D"}`},
+			err:   "index 3 out of bounds for Patient.name.given",
+		},
+		{
+			name:   "move to the end",
+			parts:  []string{`{"name":"type","valueCode":"move"}`, `{"name":"path","valueString":"Patient.identifier"}`, `{"name":"source","valueInteger":0}`, `{"name":"destination","valueInteger":2}`},
+			expect: `{"identifier":[{"system":"y","value":"2"},{"system":"x","value":"3"},{"system":"x","value":"1"}]}`,
+		},
+		{
+			name:   "move to the start",
+			parts:  []string{`{"name":"type","valueCode":"move"}`, `{"name":"path","valueString":"Patient.identifier"}`, `{"name":"source","valueInteger":2}`, `{"name":"destination","valueInteger":0}`},
+			expect: `{"identifier":[{"system":"x","value":"3"},{"system":"x","value":"1"},{"system":"y","value":"2"}]}`,
+		},
+		{
+			name:  "move past the end",
+			parts: []string{`{"name":"type","valueCode":"move"}`, `{"name":"path","valueString":"Patient.identifier"}`, `{"name":"source","valueInteger":0}`, `{"name":"destination","valueInteger":3}`},
+			err:   "index out of bounds for Patient.identifier",
+		},
+		{
+			name:   "add to a list",
+			parts:  []string{`{"name":"type","valueCode":"add"}`, `{"name":"path","valueString":"Patient"}`, `{"name":"name","valueString":"identifier"}`, `{"name":"value","valueIdentifier":{"system":"z","value":"4"}}`},
+			expect: `{"identifier":[{"system":"x","value":"1"},{"system":"y","value":"2"},{"system":"x","value":"3"},{"system":"z","value":"4"}]}`,
+		},
+		{
+			name:   "add a new list element",
+			parts:  []string{`{"name":"type","valueCode":"add"}`, `{"name":"path","valueString":"Patient.name[0]"}`, `{"name":"name","valueString":"prefix"}`, `{"name":"value","valueString":"Dr"}`},
+			expect: `{"name":[{"family":"A","given":["B","C"],"prefix":"Dr"}]}`,
+		},
+		{
+			name:  "add to an element with a value",
+			parts: []string{`{"name":"type","valueCode":"add"}`, `{"name":"path","valueString":"Patient.name[0]"}`, `{"name":"name","valueString":"family"}`, `{"name":"value","valueString":"Z"}`},
+			err:   "Patient.name[0].family already has a value",
+		},
+		{
+			name:   "replace with where and an indexer",
+			parts:  []string{`{"name":"type","valueCode":"replace"}`, `{"name":"path","valueString":"Patient.identifier.where(system='x')[1].value"}`, `{"name":"value","valueString":"9"}`},
+			expect: `{"identifier":[{"system":"x","value":"1"},{"system":"y","value":"2"},{"system":"x","value":"9"}]}`,
+		},
+		{
+			name:  "replace with several matches",
+			parts: []string{`{"name":"type","valueCode":"replace"}`, `{"name":"path","valueString":"Patient.identifier.where(system='x').value"}`, `{"name":"value","valueString":"9"}`},
+			err:   "Patient.identifier.where(system='x').value matches 2 elements, expected one",
+		},
+		{
+			name:   "delete with where",
+			parts:  []string{`{"name":"type","valueCode":"delete"}`, `{"name":"path","valueString":"Patient.identifier.where(system='y')"}`},
+			expect: `{"identifier":[{"system":"x","value":"1"},{"system":"x","value":"3"}]}`,
+		},
+		{
+			name:   "delete without a match",
+			parts:  []string{`{"name":"type","valueCode":"delete"}`, `{"name":"path","valueString":"Patient.birthDate"}`},
+			expect: `{}`,
+		},
+		{
+			name:  "delete the resource",
+			parts: []string{`{"name":"type","valueCode":"delete"}`, `{"name":"path","valueString":"Patient"}`},
+			err:   "cannot delete the resource",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			patched, err := applyFHIRPathPatch(patchSchema, decodePatchJSON(t, patchPatient), []byte(fhirPathPatch(test.parts...)))
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, expected %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expect := decodePatchJSON(t, patchPatient)
+			for key, value := range decodePatchJSON(t, test.expect) {
+				expect[key] = value
+			}
+			if !reflect.DeepEqual(patched, expect) {
+				got, _ := json.Marshal(patched)
+				t.Errorf("got %s", got)
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
+
+	"github.com/fhirrtg/fhirrtg/gql"
 )
 
 type FhirBundle struct {
@@ -17,7 +20,7 @@ type FhirBundle struct {
 }
 
 type FhirEntry struct {
-	FullUrl  string                 `json:"fullUrl"`
+	FullUrl  string                 `json:"fullUrl,omitempty"`
 	Search   *FhirEntrySearch       `json:"search,omitempty"`
 	Resource map[string]interface{} `json:"resource"`
 }
@@ -52,7 +55,7 @@ func createEntry(resource map[string]interface{}, hostname string, searchType st
 	return entry
 }
 
-func SendReadResult(w http.ResponseWriter, body []byte, statusCode int) {
+func SendReadResult(w http.ResponseWriter, body []byte, statusCode int, origReq *http.Request) {
 	var result map[string]interface{}
 	err := json.Unmarshal(body, &result)
 	if err != nil {
@@ -62,12 +65,21 @@ func SendReadResult(w http.ResponseWriter, body []byte, statusCode int) {
 		return
 	}
 
-	// Check if there is an error key and return the original body if it exists
-	if errorVal, hasError := result["errors"]; hasError && errorVal != nil {
-		SendOperationOutcome(w, result, statusCode)
+	params := RouteFromRequest(origReq)
+	if resourceGone(result, statusCode) {
+		SendIssue(w, "deleted", fmt.Sprintf("Resource %s/%s has been deleted", params.Type, params.ID), http.StatusGone)
 		return
 	}
 
+	// A resource that came back despite errors is still returned
+	if errorVal, hasError := result["errors"]; hasError && errorVal != nil {
+		if !hasPartialData(result) {
+			SendOperationOutcome(w, result, statusCode)
+			return
+		}
+		LoggerFromRequest(origReq).Warn("Upstream returned partial data", "errors", errorVal)
+	}
+
 	var resource map[string]interface{}
 
 	// Extract the resource from data.[resourceType] structure
@@ -81,6 +93,11 @@ func SendReadResult(w http.ResponseWriter, body []byte, statusCode int) {
 		}
 	}
 
+	if resource == nil && resourceMissing(result) {
+		SendIssue(w, "not-found", fmt.Sprintf("Resource %s/%s not found", params.Type, params.ID), http.StatusNotFound)
+		return
+	}
+
 	if resource == nil {
 		// Return original if we couldn't find the resource
 		w.WriteHeader(statusCode)
@@ -89,7 +106,8 @@ func SendReadResult(w http.ResponseWriter, body []byte, statusCode int) {
 	}
 
 	// Remove empty values
-	removeEmpties(resource)
+	removeEmpties(TenantFromRequest(origReq).Schema, resource)
+	rewriteReferences(resource, TenantFromRequest(origReq).UpstreamBase(), publicBase(origReq))
 
 	// Marshal the resource into JSON and return it
 	resourceBody, err := json.Marshal(resource)
@@ -100,46 +118,154 @@ func SendReadResult(w http.ResponseWriter, body []byte, statusCode int) {
 		return
 	}
 
-	w.WriteHeader(statusCode)
-	w.Write(resourceBody)
+	writeFhir(w, statusCode, resourceBody)
 }
 
-func fullHost(req *http.Request) string {
-	scheme := "http"
-	if req.TLS != nil {
-		scheme = "https"
+// resourceGone reports whether the upstream says the resource was deleted,
+// with HTTP 410 or an error code mapped to 410
+func resourceGone(result map[string]interface{}, statusCode int) bool {
+	if statusCode == http.StatusGone {
+		return true
 	}
+	for _, e := range parseGraphQLErrors(result["errors"]) {
+		if e.status() == http.StatusGone {
+			return true
+		}
+	}
+	return false
+}
 
-	return scheme + "://" + req.Host
+// resourceMissing reports whether a read returned data without a resource,
+// like {"data":{"Patient":null}}
+func resourceMissing(result map[string]interface{}) bool {
+	if errorVal, hasError := result["errors"]; hasError && errorVal != nil {
+		return false
+	}
+	data, ok := result["data"].(map[string]interface{})
+	if !ok || len(data) == 0 {
+		return false
+	}
+	for _, v := range data {
+		if v != nil {
+			return false
+		}
+	}
+	return true
 }
 
-func removeEmpties(v interface{}) {
+// removeEmpties cleans a response in place. null, "", [] and {} are invalid
+// FHIR and removed recursively, as is the resource expansion the GraphQL API
+// adds to References.
+func removeEmpties(schemaDict map[string]gql.SchemaType, v interface{}) {
 	switch data := v.(type) {
 	case map[string]interface{}:
-		for key, value := range data {
-			if value == nil {
-				delete(data, key)
-			} else if arr, ok := value.([]interface{}); ok && len(arr) == 0 {
-				delete(data, key)
-			} else if key == "resource" {
-				delete(data, key)
-			} else {
-				removeEmpties(value)
-			}
+		cleanElement(schemaDict, data, "")
+	case FhirBundle:
+		for i := range data.Entries {
+			cleanElement(schemaDict, data.Entries[i].Resource, "")
+		}
+	}
+}
+
+// cleanElement removes the empty children of obj and reports whether obj
+// ends up empty itself
+func cleanElement(schemaDict map[string]gql.SchemaType, obj map[string]interface{}, typeName string) bool {
+	if resourceType, _ := obj["resourceType"].(string); resourceType != "" {
+		typeName = resourceType
+	}
+	_, hasReference := obj["reference"]
+	isReference := typeName == "Reference" || (typeName == "" && hasReference)
+
+	// Primitive arrays and their "_" extensions are matched by position, so
+	// both keep their empty items. Paired before cleaning, as either side may
+	// be removed.
+	paired := make(map[string]bool)
+	for key := range obj {
+		if _, hasPair := obj[primitivePair(key)]; hasPair {
+			paired[key] = true
+		}
+	}
+
+	emptyLists := make(map[string]bool)
+	for key, value := range obj {
+		if key == "resource" && isReference {
+			delete(obj, key)
+			continue
 		}
+
+		childType := ""
+		if field, exists := schemaField(schemaDict, typeName, strings.TrimPrefix(key, "_")); exists {
+			childType = field.Type
+		}
+
+		cleaned, keep := cleanValue(schemaDict, value, childType, paired[key])
+		if _, isList := cleaned.([]interface{}); !keep && isList && paired[key] {
+			obj[key] = cleaned
+			emptyLists[key] = true
+		} else if keep {
+			obj[key] = cleaned
+		} else {
+			delete(obj, key)
+		}
+	}
+
+	// A list of nulls is kept while its pair has items, to stay aligned
+	for key := range emptyLists {
+		if _, pairKept := obj[primitivePair(key)]; !pairKept || emptyLists[primitivePair(key)] {
+			delete(obj, key)
+		}
+	}
+	return len(obj) == 0
+}
+
+// primitivePair returns the key of the extension of a primitive element, or
+// of the value for an extension: _given for given and given for _given
+func primitivePair(key string) string {
+	if name, isExtension := strings.CutPrefix(key, "_"); isExtension {
+		return name
+	}
+	return "_" + key
+}
+
+// cleanValue returns the cleaned value and whether it is worth keeping. With
+// keepPositions, empty list items become null instead of being removed.
+func cleanValue(schemaDict map[string]gql.SchemaType, value interface{}, typeName string, keepPositions bool) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return v, v != ""
+	case map[string]interface{}:
+		return v, !cleanElement(schemaDict, v, typeName)
 	case []interface{}:
-		for _, item := range data {
-			removeEmpties(item)
+		kept := v[:0]
+		anyKept := false
+		for _, item := range v {
+			cleaned, keep := cleanValue(schemaDict, item, typeName, false)
+			if keep {
+				kept = append(kept, cleaned)
+				anyKept = true
+			} else if keepPositions {
+				kept = append(kept, nil)
+			}
 		}
-	case FhirBundle:
-		// Process each entry in the bundle
-		for i := range data.Entries {
-			removeEmpties(data.Entries[i].Resource)
+		return kept, anyKept
+	case []map[string]interface{}:
+		kept := v[:0]
+		for _, item := range v {
+			if !cleanElement(schemaDict, item, typeName) {
+				kept = append(kept, item)
+			}
 		}
+		return kept, len(kept) > 0
 	}
+	return value, true
 }
 
 func SendBundle(w http.ResponseWriter, body []byte, statusCode int, origReq *http.Request) {
+	_, bundleSpan := startSpan(origReq.Context(), "SendBundle", SPAN_KIND_INTERNAL)
+	defer bundleSpan.End()
+
 	var jsonData map[string]interface{}
 	err := json.Unmarshal(body, &jsonData)
 	if err != nil {
@@ -148,117 +274,58 @@ func SendBundle(w http.ResponseWriter, body []byte, statusCode int, origReq *htt
 		return
 	}
 
-	// Check if there is an error key and return the original body if it exists
+	// With partial data the errors are reported as warnings in the Bundle
+	var warnings []interface{}
 	if errorVal, hasError := jsonData["errors"]; hasError && errorVal != nil {
-		SendOperationOutcome(w, jsonData, statusCode)
-		return
+		if !hasPartialData(jsonData) {
+			SendOperationOutcome(w, jsonData, statusCode)
+			return
+		}
+		warnings = graphQLIssues(parseGraphQLErrors(errorVal), "warning")
 	}
 
-	// Find all "node" keys
-	entries := make(map[string]FhirEntry)
-
-	var findNodes func(data map[string]interface{})
-	findNodes = func(data map[string]interface{}) {
-		for key, value := range data {
+	baseUrl := publicBase(origReq)
+	data, _ := jsonData["data"].(map[string]interface{})
+	entries := collectEntries(data, baseUrl, searchMatchField(origReq), warnings)
 
-			switch key {
-			case "node":
-				entry := createEntry(value.(map[string]interface{}), fullHost(origReq), "match")
-				entries[entry.FullUrl] = entry
-
-			case "resource":
-				entry := createEntry(value.(map[string]interface{}), fullHost(origReq), "include")
-				entries[entry.FullUrl] = entry
-			}
-
-			// Recursively search nested maps
-			switch v := value.(type) {
-			case map[string]interface{}:
-				findNodes(v)
-			case []interface{}:
-				for _, item := range v {
-					if m, ok := item.(map[string]interface{}); ok {
-						findNodes(m)
-					}
-				}
-			}
-		}
-	}
+	// Point references at the upstream back at this server
+	rewriteReferences(jsonData, TenantFromRequest(origReq).UpstreamBase(), baseUrl)
 
-	findNodes(jsonData)
+	bundleEntries.Observe(float64(len(entries)), RouteFromRequest(origReq).Type)
+	bundleSpan.SetAttributes("fhir.bundle.entries", len(entries))
 
-	uniqueEntries := make([]FhirEntry, 0, len(entries))
+	matches := 0
 	for _, entry := range entries {
-		uniqueEntries = append(uniqueEntries, entry)
+		if entry.Search.Mode == "match" {
+			matches++
+		}
 	}
 
 	bundle := FhirBundle{
 		ResourceType: "Bundle",
 		Type:         "searchset",
 		Timestamp:    time.Now().UTC().Format(time.RFC3339),
-		Total:        len(uniqueEntries),
-		Entries:      uniqueEntries,
+		Total:        matches,
+		Entries:      entries,
 	}
 
 	// Create links for the bundle
 	bundle.Links = []FhirLink{
 		{
 			Relation: "self",
-			Url:      origReq.URL.String(),
+			Url:      publicURL(origReq),
 		},
 	}
 
 	// Remove empty values
-	removeEmpties(bundle)
+	removeEmpties(TenantFromRequest(origReq).Schema, bundle)
 
-	body, err = json.Marshal(bundle)
+	bundleBody, err := json.Marshal(bundle)
 	if err != nil {
 		// Return original if we can't marshal
 		w.Write(body)
 		return
 	}
 
-	w.Write(body)
-}
-
-func SendOperationOutcome(w http.ResponseWriter, result map[string]interface{}, statusCode int) {
-	// Stringify the errors
-	err_str, err := json.Marshal(result["errors"])
-	if err != nil {
-		SendError(w, "There was an error processing the request", http.StatusInternalServerError)
-		return
-	}
-
-	// Safely extract error message with nil checks
-	errorText := "Unknown error"
-	if errors, ok := result["errors"].([]any); ok && len(errors) > 0 {
-		if firstError, ok := errors[0].(map[string]any); ok {
-			if msg, ok := firstError["message"].(string); ok {
-				errorText = msg
-			}
-		}
-	}
-
-	// Safely extract error code from extensions
-	errorCode := "exception"
-	if errors, ok := result["errors"].([]any); ok && len(errors) > 0 {
-		if firstError, ok := errors[0].(map[string]any); ok {
-			if extensions, ok := firstError["extensions"].(map[string]any); ok {
-				if code, ok := extensions["code"].(string); ok {
-					errorCode = code
-				}
-			}
-		}
-	}
-
-	errStr := string(err_str)
-	body := OperationOutcome(errorCode, errorText, &errStr)
-
-	// Check if errorCode is a valid HTTP status code
-	if code, err := strconv.Atoi(errorCode); err == nil && code >= 100 && code < 600 {
-		w.WriteHeader(code)
-	} else {
-		w.WriteHeader(statusCode)
-	}
-	w.Write(body)
+	writeFhir(w, statusCode, bundleBody)
 }
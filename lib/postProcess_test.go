@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+var testSchema = map[string]gql.SchemaType{
+	"Observation": {Name: "Observation", Fields: []gql.Field{
+		{Name: "subject", Type: "Reference"},
+		{Name: "code", Type: "CodeableConcept"},
+	}},
+	"Provenance": {Name: "Provenance", Fields: []gql.Field{
+		{Name: "entity", Type: "ProvenanceEntity", List: true},
+	}},
+	"ProvenanceEntity": {Name: "ProvenanceEntity", Fields: []gql.Field{
+		{Name: "role", Type: "String"},
+		{Name: "reference", Type: "String"},
+		{Name: "resource", Type: "Resource"},
+	}},
+}
+
+func decodeJSON(t *testing.T, value string) interface{} {
+	t.Helper()
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", value, err)
+	}
+	return decoded
+}
+
+func TestRemoveEmpties(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{
+			name:   "reference resource is stripped",
+			input:  `{"resourceType":"Encounter","subject":{"reference":"Patient/1","resource":{"id":"1"}}}`,
+			expect: `{"resourceType":"Encounter","subject":{"reference":"Patient/1"}}`,
+		},
+		{
+			name:   "typed reference resource is stripped",
+			input:  `{"resourceType":"Observation","subject":{"display":"A","resource":{"id":"1"}}}`,
+			expect: `{"resourceType":"Observation","subject":{"display":"A"}}`,
+		},
+		{
+			name:   "bundle entry resource is kept",
+			input:  `{"resourceType":"Bundle","entry":[{"fullUrl":"Patient/1","resource":{"resourceType":"Patient","id":"1"}}]}`,
+			expect: `{"resourceType":"Bundle","entry":[{"fullUrl":"Patient/1","resource":{"resourceType":"Patient","id":"1"}}]}`,
+		},
+		{
+			name:   "provenance entity resource is kept",
+			input:  `{"resourceType":"Provenance","entity":[{"role":"source","reference":"Patient/1","resource":{"resourceType":"Patient","id":"1"}}]}`,
+			expect: `{"resourceType":"Provenance","entity":[{"role":"source","reference":"Patient/1","resource":{"resourceType":"Patient","id":"1"}}]}`,
+		},
+		{
+			name:   "empty values are removed",
+			input:  `{"resourceType":"Patient","id":"1","active":null,"gender":"","name":[],"meta":{},"text":{"div":""}}`,
+			expect: `{"resourceType":"Patient","id":"1"}`,
+		},
+		{
+			name:   "empty list items are removed",
+			input:  `{"resourceType":"Patient","name":[{},{"family":"A","given":["","B",null]},null]}`,
+			expect: `{"resourceType":"Patient","name":[{"family":"A","given":["B"]}]}`,
+		},
+		{
+			name:   "primitive arrays stay aligned with extensions",
+			input:  `{"resourceType":"Patient","name":[{"given":["","B"],"_given":[{"id":"g1"},{}]}]}`,
+			expect: `{"resourceType":"Patient","name":[{"given":[null,"B"],"_given":[{"id":"g1"},null]}]}`,
+		},
+		{
+			name:   "empty primitive array is kept for its extensions",
+			input:  `{"resourceType":"Patient","name":[{"given":["",null],"_given":[null,{"id":"g2"}]}]}`,
+			expect: `{"resourceType":"Patient","name":[{"given":[null,null],"_given":[null,{"id":"g2"}]}]}`,
+		},
+		{
+			name:   "empty primitive array and extensions are removed",
+			input:  `{"resourceType":"Patient","name":[{"family":"A","given":["",null],"_given":[{},null]}]}`,
+			expect: `{"resourceType":"Patient","name":[{"family":"A"}]}`,
+		},
+		{
+			name:   "primitive array with null extensions",
+			input:  `{"resourceType":"Patient","name":[{"given":["",null],"_given":null}]}`,
+			expect: `{"resourceType":"Patient"}`,
+		},
+		{
+			name:   "single primitive extension without value",
+			input:  `{"resourceType":"Patient","birthDate":"","_birthDate":{"id":"b1"}}`,
+			expect: `{"resourceType":"Patient","_birthDate":{"id":"b1"}}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := decodeJSON(t, test.input)
+			removeEmpties(testSchema, input)
+			if expect := decodeJSON(t, test.expect); !reflect.DeepEqual(input, expect) {
+				got, _ := json.Marshal(input)
+				t.Errorf("got %s, expected %s", got, test.expect)
+			}
+		})
+	}
+}
+
+func TestRemoveEmptiesBundle(t *testing.T) {
+	bundle := FhirBundle{Entries: []FhirEntry{
+		{Resource: decodeJSON(t, `{"resourceType":"Observation","subject":{"reference":"Patient/1","resource":{"id":"1"}},"code":{}}`).(map[string]interface{})},
+	}}
+	removeEmpties(testSchema, bundle)
+
+	expect := decodeJSON(t, `{"resourceType":"Observation","subject":{"reference":"Patient/1"}}`)
+	if !reflect.DeepEqual(bundle.Entries[0].Resource, expect) {
+		got, _ := json.Marshal(bundle.Entries[0].Resource)
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestCleanElement(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		typeName string
+		expect   string
+		empty    bool
+	}{
+		{"empty object", `{}`, "", `{}`, true},
+		{"only empty children", `{"a":{},"b":"","c":null,"d":[{}]}`, "", `{}`, true},
+		{"reference resource only", `{"resource":{"id":"1"}}`, "Reference", `{}`, true},
+		{"untyped resource without reference", `{"resource":{"id":"1"}}`, "", `{"resource":{"id":"1"}}`, false},
+		{"typed resource element", `{"reference":"Patient/1","resource":{"id":"1"}}`, "ProvenanceEntity", `{"reference":"Patient/1","resource":{"id":"1"}}`, false},
+		{"numbers and booleans are kept", `{"value":0,"active":false}`, "", `{"value":0,"active":false}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := decodeJSON(t, test.input).(map[string]interface{})
+			empty := cleanElement(testSchema, input, test.typeName)
+			if empty != test.empty {
+				t.Errorf("empty: got %v, expected %v", empty, test.empty)
+			}
+			if expect := decodeJSON(t, test.expect); !reflect.DeepEqual(input, expect) {
+				got, _ := json.Marshal(input)
+				t.Errorf("got %s, expected %s", got, test.expect)
+			}
+		})
+	}
+}
+
+func TestCleanValue(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         interface{}
+		keepPositions bool
+		expect        interface{}
+		keep          bool
+	}{
+		{"null", nil, false, nil, false},
+		{"empty string", "", false, "", false},
+		{"string", "a", false, "a", true},
+		{"number", 1.5, false, 1.5, true},
+		{"empty object", map[string]interface{}{}, false, map[string]interface{}{}, false},
+		{"empty list", []interface{}{}, false, []interface{}{}, false},
+		{"list without empty items", []interface{}{"a", "", nil, "b"}, false, []interface{}{"a", "b"}, true},
+		{"list keeping positions", []interface{}{"a", "", nil, "b"}, true, []interface{}{"a", nil, nil, "b"}, true},
+		{"empty list keeping positions", []interface{}{"", nil}, true, []interface{}{nil, nil}, false},
+		{
+			"list of objects",
+			[]map[string]interface{}{{}, {"a": "b"}, {"c": ""}},
+			false,
+			[]map[string]interface{}{{"a": "b"}},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cleaned, keep := cleanValue(testSchema, test.input, "", test.keepPositions)
+			if keep != test.keep {
+				t.Errorf("keep: got %v, expected %v", keep, test.keep)
+			}
+			if !reflect.DeepEqual(cleaned, test.expect) {
+				t.Errorf("got %#v, expected %#v", cleaned, test.expect)
+			}
+		})
+	}
+}
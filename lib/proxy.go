@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type ctxPublicBaseKey struct{}
+
+// ctxUpstreamCredentialsKey holds the Authorization header ProxyRequest got
+// for the upstream
+type ctxUpstreamCredentialsKey struct{}
+
+const (
+	PROXY_ALLOW   = "allow"
+	PROXY_DENY    = "deny"
+	PROXY_REWRITE = "rewrite"
+)
+
+// proxyRoute decides what happens to a request that is not handled by the
+// GraphQL translation and falls through to the upstream FHIR server
+type proxyRoute struct {
+	Action string
+	Prefix string
+	Target string // replacement prefix for rewrite routes
+}
+
+// parseProxyRoutes parses a comma separated list of routes in the form
+// "allow:/metadata", "deny:/admin" or "rewrite:/old=/new"
+func parseProxyRoutes(spec string) ([]proxyRoute, error) {
+	var routes []proxyRoute
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		action, rest, found := strings.Cut(item, ":")
+		if !found || !strings.HasPrefix(rest, "/") {
+			return nil, fmt.Errorf("invalid proxy route: %s", item)
+		}
+
+		route := proxyRoute{Action: strings.ToLower(action), Prefix: rest}
+		switch route.Action {
+		case PROXY_ALLOW, PROXY_DENY:
+		case PROXY_REWRITE:
+			prefix, target, found := strings.Cut(rest, "=")
+			if !found || !strings.HasPrefix(target, "/") {
+				return nil, fmt.Errorf("invalid proxy rewrite route: %s", item)
+			}
+			route.Prefix = prefix
+			route.Target = target
+		default:
+			return nil, fmt.Errorf("invalid proxy route action: %s", action)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// canonicalPath reports whether path is already clean: no empty, "." or ".."
+// segments. A trailing slash is allowed.
+func canonicalPath(urlPath string) bool {
+	if urlPath == "" {
+		return true
+	}
+	cleaned := path.Clean(urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned == urlPath
+}
+
+// matchProxyRoute returns the first configured route whose prefix matches
+// path, or a route with the fallback action
+func matchProxyRoute(path string) proxyRoute {
+	for _, route := range PROXY_ROUTES {
+		if path == route.Prefix || strings.HasPrefix(path, strings.TrimSuffix(route.Prefix, "/")+"/") {
+			return route
+		}
+	}
+	return proxyRoute{Action: PROXY_FALLBACK}
+}
+
+func newUpstreamProxy(tenant *Tenant) (*httputil.ReverseProxy, error) {
+	target, err := url.Parse(tenant.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	upstreamBase := tenant.UpstreamBase()
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			filterUpstreamHeaders(tenant, r.Out.Header)
+			r.Out.Header["X-Forwarded-For"] = r.In.Header["X-Forwarded-For"]
+			r.SetXForwarded()
+			r.SetURL(target)
+			tenant.setHeaders(r.Out.Header)
+			if credentials, _ := r.In.Context().Value(ctxUpstreamCredentialsKey{}).(string); credentials != "" {
+				r.Out.Header.Set("Authorization", credentials)
+			}
+			injectTraceContext(r.In.Context(), r.Out.Header)
+		},
+		Transport:     client.Transport,
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			base, _ := resp.Request.Context().Value(ctxPublicBaseKey{}).(string)
+			return rewriteProxyResponse(resp, upstreamBase, base)
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			LoggerFromRequest(req).Error("Error sending proxy request upstream:", "error", err)
+			SendError(w, "Failed to send proxy request", http.StatusBadGateway)
+		},
+	}, nil
+}
+
+// rewriteProxyResponse replaces upstream absolute URLs with the public base
+// in the Location and Link headers and in FHIR JSON Bundle links and fullUrls
+func rewriteProxyResponse(resp *http.Response, upstreamBase string, publicBase string) error {
+	if publicBase == "" || upstreamBase == publicBase {
+		return nil
+	}
+
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", rewriteUpstreamURL(location, upstreamBase, publicBase))
+	}
+	if links := resp.Header.Values("Link"); len(links) > 0 {
+		resp.Header.Del("Link")
+		for _, link := range links {
+			resp.Header.Add("Link", strings.ReplaceAll(link, "<"+upstreamBase, "<"+publicBase))
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/fhir+json" && mediaType != "application/json" {
+		// Everything else is streamed through untouched
+		return nil
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	body = rewriteBundleURLs(body, upstreamBase, publicBase)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func rewriteUpstreamURL(value string, upstreamBase string, publicBase string) string {
+	if value == upstreamBase || strings.HasPrefix(value, upstreamBase+"/") || strings.HasPrefix(value, upstreamBase+"?") {
+		return publicBase + strings.TrimPrefix(value, upstreamBase)
+	}
+	return value
+}
+
+// rewriteBundleURLs rewrites Bundle.link.url and Bundle.entry.fullUrl, leaving
+// the body untouched if it is not a Bundle
+func rewriteBundleURLs(body []byte, upstreamBase string, publicBase string) []byte {
+	var bundle map[string]json.RawMessage
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		return body
+	}
+	var resourceType string
+	if err := json.Unmarshal(bundle["resourceType"], &resourceType); err != nil || resourceType != "Bundle" {
+		return body
+	}
+
+	rewriteList := func(key string, field string) {
+		var items []map[string]json.RawMessage
+		if err := json.Unmarshal(bundle[key], &items); err != nil {
+			return
+		}
+		for _, item := range items {
+			var value string
+			if err := json.Unmarshal(item[field], &value); err != nil {
+				continue
+			}
+			item[field], _ = json.Marshal(rewriteUpstreamURL(value, upstreamBase, publicBase))
+		}
+		if raw, err := json.Marshal(items); err == nil {
+			bundle[key] = raw
+		}
+	}
+	rewriteList("link", "url")
+	rewriteList("entry", "fullUrl")
+
+	rewritten, err := json.Marshal(bundle)
+	if err != nil {
+		return body
+	}
+	return rewritten
+}
+
+// ProxyRequest forwards a request that cannot be translated to GraphQL to the
+// upstream FHIR server, subject to the configured proxy routes
+func ProxyRequest(w http.ResponseWriter, origReq *http.Request) {
+	ctxLog := LoggerFromRequest(origReq)
+
+	// Routes match path prefixes, which "//admin" or "/x/../admin" would get
+	// around while the upstream may still resolve them to /admin
+	if !canonicalPath(origReq.URL.Path) {
+		ctxLog.Info("Proxy path not canonical", "path", origReq.URL.Path)
+		SendError(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	route := matchProxyRoute(origReq.URL.Path)
+	switch route.Action {
+	case PROXY_DENY:
+		ctxLog.Info("Proxy route denied", "prefix", route.Prefix)
+		SendError(w, "Not Found", http.StatusNotFound)
+		return
+	case PROXY_REWRITE:
+		origReq.URL.Path = route.Target + strings.TrimPrefix(origReq.URL.Path, route.Prefix)
+		origReq.URL.RawPath = ""
+	}
+
+	// Upstream credentials are only lent to authorized requests
+	if !requestAuthorized(origReq) {
+		ctxLog.Info("Proxy request not authorized", "path", origReq.URL.Path)
+		sendAuthError(w, origReq, &authError{http.StatusUnauthorized, "Authentication required"})
+		return
+	}
+	tenant := TenantFromRequest(origReq)
+	credentials := http.Header{}
+	if err := tenant.setCredentials(origReq.Context(), credentials); err != nil {
+		ctxLog.Error("Error authenticating proxy request:", "error", err)
+		SendError(w, "Failed to authenticate with the upstream server", http.StatusBadGateway)
+		return
+	}
+
+	ctxLog.Info("Proxying request", "path", origReq.URL.Path)
+	ctx, proxySpan := startSpan(origReq.Context(), "proxy", SPAN_KIND_CLIENT)
+	defer proxySpan.End()
+	proxySpan.SetAttributes("server.address", tenant.Upstream, "url.path", origReq.URL.Path)
+	ctx = context.WithValue(ctx, ctxPublicBaseKey{}, publicBase(origReq))
+	ctx = context.WithValue(ctx, ctxUpstreamCredentialsKey{}, credentials.Get("Authorization"))
+	tenant.proxy.ServeHTTP(w, origReq.WithContext(ctx))
+}
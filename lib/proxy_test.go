@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		expect bool
+	}{
+		{"", true},
+		{"/", true},
+		{"/admin", true},
+		{"/admin/", true},
+		{"/admin/users", true},
+		{"//admin", false},
+		{"/admin//users", false},
+		{"/x/../admin", false},
+		{"/./admin", false},
+		{"/admin/.", false},
+		{"/admin/..", false},
+	}
+
+	for _, test := range tests {
+		if got := canonicalPath(test.path); got != test.expect {
+			t.Errorf("canonicalPath(%q): got %v, expected %v", test.path, got, test.expect)
+		}
+	}
+}
+
+func TestMatchProxyRoute(t *testing.T) {
+	savedRoutes, savedFallback := PROXY_ROUTES, PROXY_FALLBACK
+	defer func() { PROXY_ROUTES, PROXY_FALLBACK = savedRoutes, savedFallback }()
+
+	routes, err := parseProxyRoutes("deny:/admin,rewrite:/old=/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	PROXY_ROUTES, PROXY_FALLBACK = routes, PROXY_ALLOW
+
+	tests := []struct {
+		path   string
+		action string
+	}{
+		{"/admin", PROXY_DENY},
+		{"/admin/", PROXY_DENY},
+		{"/admin/users", PROXY_DENY},
+		{"/administrator", PROXY_ALLOW},
+		{"/old/x", PROXY_REWRITE},
+		{"/other", PROXY_ALLOW},
+	}
+
+	for _, test := range tests {
+		if route := matchProxyRoute(test.path); route.Action != test.action {
+			t.Errorf("matchProxyRoute(%q): got %s, expected %s", test.path, route.Action, test.action)
+		}
+	}
+}
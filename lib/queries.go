@@ -4,13 +4,13 @@ import (
 	"github.com/fhirrtg/fhirrtg/gql"
 )
 
-func GenerateFragment(typeName string) gql.Fragment {
+func GenerateFragment(schemaDict map[string]gql.SchemaType, typeName string) gql.Fragment {
 	schema := schemaDict[typeName]
 
 	fragment := gql.Fragment{
 		Name:   typeName + "Fragment",
 		Type:   typeName,
-		Fields: buildFieldTree(schema.Fields, 0),
+		Fields: buildFieldTree(schemaDict, schema.Fields, 0),
 	}
 
 	return fragment
@@ -79,3 +79,58 @@ func FullResourceRequest(
 
 	return query
 }
+
+// SystemSearchRequest searches several resource types at once, with one
+// aliased connection field per type
+func SystemSearchRequest(
+	resourceTypes []string,
+	searchParams gql.Arguments,
+	fragments map[string]gql.Fragment,
+) gql.Query {
+
+	var primaryArgs gql.Arguments
+	if len(searchParams) > 0 {
+		primaryArgs = gql.Arguments{"search": gql.ArgumentValue{SubArguments: searchParams}}
+	}
+
+	fields := []gql.Field{}
+	for _, resourceType := range resourceTypes {
+		fields = append(fields, gql.Field{
+			Name:       resourceType,
+			Alias:      resourceType,
+			Arguments:  primaryArgs,
+			Fragments:  []gql.Fragment{fragments[resourceType]},
+			Connection: true,
+		})
+	}
+
+	query := gql.Query{
+		Operation: "query",
+		Name:      "SystemSearch",
+		Fields:    fields,
+	}
+
+	return query
+}
+
+// ReadRequest reads a single resource by id, returning the query with its
+// fragment
+func ReadRequest(schemaDict map[string]gql.SchemaType, resourceType string, id string) string {
+	fragment := GenerateFragment(schemaDict, resourceType)
+
+	query := gql.Query{
+		Operation: "query",
+		Name:      "Get" + resourceType,
+		Fields: []gql.Field{
+			{
+				Name: resourceType,
+				Arguments: gql.Arguments{
+					"id": gql.ArgumentValue{Value: id},
+				},
+				Fragments: []gql.Fragment{fragment},
+			},
+		},
+	}
+
+	return fragment.String() + "\n" + query.String()
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+type ctxRouteKey struct{}
+
+// FHIR RESTful interactions, see https://hl7.org/fhir/http.html
+const (
+	INTERACTION_READ               = "read"
+	INTERACTION_VREAD              = "vread"
+	INTERACTION_UPDATE             = "update"
+	INTERACTION_PATCH              = "patch"
+	INTERACTION_DELETE             = "delete"
+	INTERACTION_HISTORY_INSTANCE   = "history-instance"
+	INTERACTION_HISTORY_TYPE       = "history-type"
+	INTERACTION_HISTORY_SYSTEM     = "history-system"
+	INTERACTION_CREATE             = "create"
+	INTERACTION_SEARCH_TYPE        = "search-type"
+	INTERACTION_SEARCH_COMPARTMENT = "search-compartment"
+	INTERACTION_SEARCH_SYSTEM      = "search-system"
+	INTERACTION_CAPABILITIES       = "capabilities"
+	INTERACTION_BATCH              = "batch"
+	INTERACTION_OPERATION          = "operation"
+)
+
+// RouteParams holds the path parameters of a matched route
+type RouteParams struct {
+	Interaction string
+	Type        string
+	ID          string
+	VersionID   string
+	Operation   string
+	Compartment string
+	File        string
+}
+
+type routeHandler func(w http.ResponseWriter, req *http.Request, params RouteParams)
+
+// fhirRoute maps a method and path pattern to an interaction. Pattern
+// segments are literals or one of {type}, {id}, {vid}, {op}, {compartment}
+// and {file}. Routes without a handler are proxied to the upstream.
+type fhirRoute struct {
+	Interaction string
+	Method      string
+	Pattern     string
+	Handler     routeHandler
+}
+
+var fhirRoutes = []fhirRoute{
+	{INTERACTION_CAPABILITIES, http.MethodGet, "/metadata", nil},
+	{INTERACTION_SEARCH_SYSTEM, http.MethodGet, "/", systemSearchHandler},
+	{INTERACTION_BATCH, http.MethodPost, "/", nil},
+	{INTERACTION_HISTORY_SYSTEM, http.MethodGet, "/_history", nil},
+	{INTERACTION_SEARCH_SYSTEM, http.MethodPost, "/_search", systemSearchPostHandler},
+	{INTERACTION_OPERATION, http.MethodGet, "/$export", exportHandler},
+	{INTERACTION_OPERATION, http.MethodPost, "/$export", exportHandler},
+	{INTERACTION_OPERATION, http.MethodGet, EXPORT_STATUS_PATH + "/{id}", exportStatusHandler},
+	{INTERACTION_OPERATION, http.MethodDelete, EXPORT_STATUS_PATH + "/{id}", exportDeleteHandler},
+	{INTERACTION_OPERATION, http.MethodGet, EXPORT_FILE_PATH + "/{id}/{file}", exportFileHandler},
+	{INTERACTION_OPERATION, http.MethodGet, ASYNC_STATUS_PATH + "/{id}", asyncStatusHandler},
+	{INTERACTION_OPERATION, http.MethodDelete, ASYNC_STATUS_PATH + "/{id}", asyncDeleteHandler},
+	{INTERACTION_OPERATION, http.MethodGet, "/{op}", nil},
+	{INTERACTION_OPERATION, http.MethodPost, "/{op}", nil},
+
+	{INTERACTION_SEARCH_TYPE, http.MethodGet, "/{type}", searchHandler},
+	{INTERACTION_CREATE, http.MethodPost, "/{type}", createHandler},
+	{INTERACTION_SEARCH_TYPE, http.MethodPost, "/{type}/_search", searchPostHandler},
+	{INTERACTION_HISTORY_TYPE, http.MethodGet, "/{type}/_history", nil},
+	{INTERACTION_OPERATION, http.MethodGet, "/{type}/$export", exportHandler},
+	{INTERACTION_OPERATION, http.MethodPost, "/{type}/$export", exportHandler},
+	{INTERACTION_OPERATION, http.MethodGet, "/{type}/{op}", nil},
+	{INTERACTION_OPERATION, http.MethodPost, "/{type}/{op}", nil},
+
+	{INTERACTION_READ, http.MethodGet, "/{type}/{id}", readHandler},
+	{INTERACTION_UPDATE, http.MethodPut, "/{type}/{id}", updateHandler},
+	{INTERACTION_PATCH, http.MethodPatch, "/{type}/{id}", patchHandler},
+	{INTERACTION_DELETE, http.MethodDelete, "/{type}/{id}", nil},
+	{INTERACTION_HISTORY_INSTANCE, http.MethodGet, "/{type}/{id}/_history", nil},
+	{INTERACTION_VREAD, http.MethodGet, "/{type}/{id}/_history/{vid}", nil},
+	{INTERACTION_OPERATION, http.MethodGet, "/{type}/{id}/$export", exportHandler},
+	{INTERACTION_OPERATION, http.MethodPost, "/{type}/{id}/$export", exportHandler},
+	{INTERACTION_OPERATION, http.MethodGet, "/{type}/{id}/{op}", nil},
+	{INTERACTION_OPERATION, http.MethodPost, "/{type}/{id}/{op}", nil},
+	{INTERACTION_SEARCH_COMPARTMENT, http.MethodGet, "/{type}/{id}/{compartment}", nil},
+}
+
+func searchHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	fhirSearch(w, req, params.Type)
+}
+
+func searchPostHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	formSearch(w, req, "/"+params.Type, func(w http.ResponseWriter, req *http.Request) {
+		fhirSearch(w, req, params.Type)
+	})
+}
+
+// systemSearchHandler serves GET [base]?params. The bare server root has no
+// search parameters and is passed on to the upstream.
+func systemSearchHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	if req.URL.RawQuery == "" {
+		ProxyRequest(w, req)
+		return
+	}
+	fhirSystemSearch(w, req)
+}
+
+func systemSearchPostHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	formSearch(w, req, "/", fhirSystemSearch)
+}
+
+// formSearch serves POST _search. The form-encoded body is merged with the
+// URL query and the search then runs as the equivalent GET on path, so the
+// parameters never show up in the access log.
+func formSearch(w http.ResponseWriter, req *http.Request, path string, search http.HandlerFunc) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		SendError(w, "POST _search requires an application/x-www-form-urlencoded body", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		SendError(w, "Invalid search parameters", http.StatusBadRequest)
+		return
+	}
+
+	searchReq := req.Clone(req.Context())
+	searchReq.URL.Path = path
+	searchReq.URL.RawQuery = req.Form.Encode()
+	searchReq.Body = http.NoBody
+	searchReq.ContentLength = 0
+	searchReq.Header.Del("Content-Type")
+	searchReq.Header.Del("Content-Length")
+	search(w, searchReq)
+}
+
+func readHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	fhirRead(w, req, params.Type, params.ID)
+}
+
+func createHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	LoggerFromRequest(req).Info("Create Resource", "type", params.Type)
+	FhirCreate(w, req, params.Type)
+}
+
+func updateHandler(w http.ResponseWriter, req *http.Request, params RouteParams) {
+	LoggerFromRequest(req).Info("Update Resource", "type", params.Type, "id", params.ID)
+	FhirUpdate(w, req, params.Type, params.ID)
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+func isPlainSegment(segment string) bool {
+	return segment != "" && !strings.HasPrefix(segment, "_") && !strings.HasPrefix(segment, "$")
+}
+
+// matchPattern matches path segments against a route pattern, filling in
+// params on success
+func matchPattern(schema map[string]gql.SchemaType, pattern []string, segments []string, params *RouteParams) bool {
+	if len(pattern) != len(segments) {
+		return false
+	}
+	for i, part := range pattern {
+		segment := segments[i]
+		switch part {
+		case "{type}":
+			if validateResource(schema, segment) != nil {
+				return false
+			}
+			params.Type = segment
+		case "{compartment}":
+			if segment != "*" && validateResource(schema, segment) != nil {
+				return false
+			}
+			params.Compartment = segment
+		case "{id}":
+			if !isPlainSegment(segment) {
+				return false
+			}
+			params.ID = segment
+		case "{vid}":
+			if !isPlainSegment(segment) {
+				return false
+			}
+			params.VersionID = segment
+		case "{op}":
+			if len(segment) < 2 || !strings.HasPrefix(segment, "$") {
+				return false
+			}
+			params.Operation = segment
+		case "{file}":
+			if !isPlainSegment(segment) {
+				return false
+			}
+			params.File = segment
+		default:
+			if part != segment {
+				return false
+			}
+			if strings.HasPrefix(part, "$") {
+				params.Operation = part
+			}
+		}
+	}
+	return true
+}
+
+// matchRoute finds the route for method and path. If the path matches but the
+// method does not, the allowed methods are returned instead.
+func matchRoute(schema map[string]gql.SchemaType, method string, path string) (*fhirRoute, RouteParams, []string) {
+	segments := splitPath(path)
+	var allowed []string
+
+	for i := range fhirRoutes {
+		route := &fhirRoutes[i]
+		params := RouteParams{Interaction: route.Interaction}
+		if !matchPattern(schema, splitPath(route.Pattern), segments, &params) {
+			continue
+		}
+		if route.Method == method {
+			return route, params, nil
+		}
+		allowed = appendUnique(allowed, route.Method)
+	}
+	if method == http.MethodHead && containsString(allowed, http.MethodGet) {
+		return matchRoute(schema, http.MethodGet, path)
+	}
+	return nil, RouteParams{}, allowed
+}
+
+func appendUnique(values []string, value string) []string {
+	if containsString(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func withRoute(req *http.Request, params RouteParams) *http.Request {
+	if slot, ok := req.Context().Value(ctxRouteSlotKey{}).(*RouteParams); ok {
+		*slot = params
+	}
+	ctx := context.WithValue(req.Context(), ctxRouteKey{}, params)
+	return req.WithContext(ctx)
+}
+
+// RouteFromRequest returns the route parameters dispatch matched for req
+func RouteFromRequest(r *http.Request) RouteParams {
+	if params, ok := r.Context().Value(ctxRouteKey{}).(RouteParams); ok {
+		return params
+	}
+	return RouteParams{}
+}
+
+// routeFhirRequest dispatches req to the handler of the matching FHIR route
+func routeFhirRequest(w http.ResponseWriter, req *http.Request, schema map[string]gql.SchemaType) {
+	ctxLog := LoggerFromRequest(req)
+
+	// The route span covers matching and authorization
+	_, routeSpan := startSpan(req.Context(), "route", SPAN_KIND_INTERNAL)
+	route, params, allowed := matchRoute(schema, req.Method, req.URL.Path)
+	if route == nil {
+		routeSpan.End()
+		if len(allowed) > 0 {
+			ctxLog.Info("Method not allowed", "allow", allowed)
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			SendError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		segments := splitPath(req.URL.Path)
+		if len(segments) > 0 && validateResource(schema, segments[0]) == nil {
+			ctxLog.Error("Bad Request")
+			SendError(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		// Not a FHIR route we know, let the upstream decide. Without a route
+		// there are no scopes to check, but the client must be authenticated.
+		if authEnabled() && AuthFromRequest(req) == nil {
+			ctxLog.Info("Request not authorized", "path", req.URL.Path)
+			sendAuthError(w, req, &authError{http.StatusUnauthorized, "Authentication required"})
+			return
+		}
+		ProxyRequest(w, withAuthorized(req))
+		return
+	}
+
+	ctxLog.Debug("matched route", "interaction", params.Interaction, "type", params.Type, "id", params.ID)
+	req = withRoute(req, params)
+
+	req, authErr := authorizeRequest(req, params)
+	routeSpan.SetAttributes("fhir.interaction", params.Interaction, "fhir.resource_type", params.Type)
+	if authErr != nil {
+		routeSpan.SetError(authErr.Error())
+	}
+	routeSpan.End()
+	if authErr != nil {
+		ctxLog.Info("Request not authorized", "interaction", params.Interaction, "error", authErr)
+		sendAuthError(w, req, authErr)
+		return
+	}
+	if route.Handler == nil {
+		ProxyRequest(w, req)
+		return
+	}
+	if containsString(asyncInteractions, params.Interaction) && preferRespondAsync(req) {
+		startAsync(w, req, route.Handler, params)
+		return
+	}
+	route.Handler(w, req, params)
+}
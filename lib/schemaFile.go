@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+// loadSchemaFile builds the field dictionary from a local file instead of
+// introspecting the upstream server. Both GraphQL SDL and introspection JSON
+// (with or without the {"data": ...} envelope) are accepted.
+func loadSchemaFile(path string) (map[string]gql.SchemaType, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file %s: %w", path, err)
+	}
+
+	var types []IntrospectionType
+	if isIntrospectionJSON(path, content) {
+		types, err = parseIntrospectionJSON(content)
+	} else {
+		types, err = parseSDL(string(content))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema file %s: %w", path, err)
+	}
+
+	fd := buildFieldDictFromTypes(types)
+	if err := checkFieldDict(fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func isIntrospectionJSON(path string, content []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return true
+	case ".graphql", ".graphqls", ".gql", ".sdl":
+		return false
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(content), []byte("{"))
+}
+
+func parseIntrospectionJSON(content []byte) ([]IntrospectionType, error) {
+	var introspection IntrospectionResponse
+	if err := json.Unmarshal(content, &introspection); err != nil {
+		return nil, err
+	}
+	if len(introspection.Data.Schema.Types) > 0 {
+		return introspection.Data.Schema.Types, nil
+	}
+
+	// Bare introspection result without the response envelope
+	var data IntrospectionData
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Schema.Types) == 0 {
+		return nil, fmt.Errorf("no __schema.types found")
+	}
+	return data.Schema.Types, nil
+}
+
+// dumpSchema writes the live introspection result of the tenant's upstream
+// server to path so it can be checked in and used with RTG_SCHEMA_FILE
+func dumpSchema(tenant *Tenant, path string) error {
+	body, err := fetchIntrospection(tenant)
+	if err != nil {
+		return err
+	}
+
+	fd, err := buildFieldDict(body)
+	if err != nil {
+		return err
+	}
+	if err := checkFieldDict(fd); err != nil {
+		return err
+	}
+	tenant.Schema = fd
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, body, "", "  "); err != nil {
+		return err
+	}
+	pretty.WriteString("\n")
+
+	if path == "-" {
+		_, err = os.Stdout.Write(pretty.Bytes())
+		return err
+	}
+	return os.WriteFile(path, pretty.Bytes(), 0644)
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Minimal GraphQL SDL reader. It only extracts what the introspection query
+// asks for (type names, kinds, possible types and field types) and skips
+// descriptions, arguments, default values and directives.
+
+var sdlBuiltinScalars = []string{"Int", "Float", "String", "Boolean", "ID"}
+
+type sdlTokenKind int
+
+const (
+	sdlEOF sdlTokenKind = iota
+	sdlName
+	sdlPunct
+	sdlString
+	sdlNumber
+)
+
+type sdlToken struct {
+	Kind  sdlTokenKind
+	Value string
+	Line  int
+}
+
+type sdlTypeRef struct {
+	Kind   string // LIST, NON_NULL or "" for a named type
+	Name   string
+	OfType *sdlTypeRef
+}
+
+type sdlField struct {
+	Name string
+	Type *sdlTypeRef
+}
+
+type sdlType struct {
+	Name       string
+	Kind       string
+	Fields     []sdlField
+	Members    []string
+	Interfaces []string
+}
+
+type sdlParser struct {
+	tokens []sdlToken
+	pos    int
+	types  map[string]*sdlType
+	order  []string
+}
+
+func sdlNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func sdlDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func sdlTokenize(src string) ([]sdlToken, error) {
+	var tokens []sdlToken
+	line := 1
+	i := 0
+	src = strings.TrimPrefix(src, "\ufeff")
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], `"""`):
+			end := strings.Index(src[i+3:], `"""`)
+			for end >= 0 && src[i+3+end-1] == '\\' {
+				next := strings.Index(src[i+3+end+3:], `"""`)
+				if next < 0 {
+					end = -1
+					break
+				}
+				end += 3 + next
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated block string on line %d", line)
+			}
+			value := src[i+3 : i+3+end]
+			tokens = append(tokens, sdlToken{Kind: sdlString, Value: value, Line: line})
+			line += strings.Count(value, "\n")
+			i += end + 6
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				if j < len(src) && src[j] == '\n' {
+					return nil, fmt.Errorf("unterminated string on line %d", line)
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string on line %d", line)
+			}
+			tokens = append(tokens, sdlToken{Kind: sdlString, Value: src[i+1 : j], Line: line})
+			i = j + 1
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, sdlToken{Kind: sdlPunct, Value: "...", Line: line})
+			i += 3
+		case strings.ContainsRune("!$&():=@[]{}|", rune(c)):
+			tokens = append(tokens, sdlToken{Kind: sdlPunct, Value: string(c), Line: line})
+			i++
+		case sdlNameStart(c):
+			j := i
+			for j < len(src) && (sdlNameStart(src[j]) || sdlDigit(src[j])) {
+				j++
+			}
+			tokens = append(tokens, sdlToken{Kind: sdlName, Value: src[i:j], Line: line})
+			i = j
+		case c == '-' || sdlDigit(c):
+			j := i + 1
+			for j < len(src) && strings.ContainsRune("0123456789.eE+-", rune(src[j])) {
+				j++
+			}
+			tokens = append(tokens, sdlToken{Kind: sdlNumber, Value: src[i:j], Line: line})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q on line %d", c, line)
+		}
+	}
+	tokens = append(tokens, sdlToken{Kind: sdlEOF, Line: line})
+	return tokens, nil
+}
+
+func (p *sdlParser) peek() sdlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sdlParser) next() sdlToken {
+	tok := p.tokens[p.pos]
+	if tok.Kind != sdlEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *sdlParser) isPunct(value string) bool {
+	tok := p.peek()
+	return tok.Kind == sdlPunct && tok.Value == value
+}
+
+func (p *sdlParser) skipPunct(value string) bool {
+	if p.isPunct(value) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sdlParser) expectPunct(value string) error {
+	if !p.skipPunct(value) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q on line %d, got %q", value, tok.Line, tok.Value)
+	}
+	return nil
+}
+
+func (p *sdlParser) expectName() (string, error) {
+	tok := p.next()
+	if tok.Kind != sdlName {
+		return "", fmt.Errorf("expected name on line %d, got %q", tok.Line, tok.Value)
+	}
+	return tok.Value, nil
+}
+
+func (p *sdlParser) skipDescription() {
+	if p.peek().Kind == sdlString {
+		p.pos++
+	}
+}
+
+// skipBalanced skips a bracketed group starting at the current token
+func (p *sdlParser) skipBalanced(open, close string) error {
+	if err := p.expectPunct(open); err != nil {
+		return err
+	}
+	depth := 1
+	for depth > 0 {
+		tok := p.next()
+		if tok.Kind == sdlEOF {
+			return fmt.Errorf("unbalanced %q", open)
+		}
+		if tok.Kind != sdlPunct {
+			continue
+		}
+		switch tok.Value {
+		case open:
+			depth++
+		case close:
+			depth--
+		}
+	}
+	return nil
+}
+
+func (p *sdlParser) skipDirectives() error {
+	for p.skipPunct("@") {
+		if _, err := p.expectName(); err != nil {
+			return err
+		}
+		if p.isPunct("(") {
+			if err := p.skipBalanced("(", ")"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *sdlParser) skipValue() error {
+	switch {
+	case p.isPunct("["):
+		return p.skipBalanced("[", "]")
+	case p.isPunct("{"):
+		return p.skipBalanced("{", "}")
+	case p.skipPunct("$"):
+		_, err := p.expectName()
+		return err
+	}
+	tok := p.next()
+	if tok.Kind == sdlPunct || tok.Kind == sdlEOF {
+		return fmt.Errorf("expected value on line %d, got %q", tok.Line, tok.Value)
+	}
+	return nil
+}
+
+func (p *sdlParser) parseTypeRef() (*sdlTypeRef, error) {
+	var ref *sdlTypeRef
+	if p.skipPunct("[") {
+		inner, err := p.parseTypeRef()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return nil, err
+		}
+		ref = &sdlTypeRef{Kind: "LIST", OfType: inner}
+	} else {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		ref = &sdlTypeRef{Name: name}
+	}
+	if p.skipPunct("!") {
+		ref = &sdlTypeRef{Kind: "NON_NULL", OfType: ref}
+	}
+	return ref, nil
+}
+
+func (p *sdlParser) typeNamed(name string, kind string) *sdlType {
+	typ, exists := p.types[name]
+	if !exists {
+		typ = &sdlType{Name: name}
+		p.types[name] = typ
+		p.order = append(p.order, name)
+	}
+	if kind != "" {
+		typ.Kind = kind
+	}
+	return typ
+}
+
+func (p *sdlParser) parseImplements() ([]string, error) {
+	var names []string
+	if p.peek().Kind != sdlName || p.peek().Value != "implements" {
+		return nil, nil
+	}
+	p.pos++
+	p.skipPunct("&")
+	for {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.skipPunct("&") {
+			return names, nil
+		}
+	}
+}
+
+func (p *sdlParser) parseFields(input bool) ([]sdlField, error) {
+	var fields []sdlField
+	if !p.skipPunct("{") {
+		return nil, nil
+	}
+	for !p.skipPunct("}") {
+		p.skipDescription()
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		if p.isPunct("(") {
+			if err := p.skipBalanced("(", ")"); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+		typeRef, err := p.parseTypeRef()
+		if err != nil {
+			return nil, err
+		}
+		if input && p.skipPunct("=") {
+			if err := p.skipValue(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.skipDirectives(); err != nil {
+			return nil, err
+		}
+		fields = append(fields, sdlField{Name: name, Type: typeRef})
+	}
+	return fields, nil
+}
+
+func (p *sdlParser) parseEnumValues() error {
+	if !p.skipPunct("{") {
+		return nil
+	}
+	for !p.skipPunct("}") {
+		p.skipDescription()
+		if _, err := p.expectName(); err != nil {
+			return err
+		}
+		if err := p.skipDirectives(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseNameList reads "A | B | C", allowing a leading "|"
+func (p *sdlParser) parseNameList() ([]string, error) {
+	var names []string
+	p.skipPunct("|")
+	for {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.skipPunct("|") {
+			return names, nil
+		}
+	}
+}
+
+func (p *sdlParser) parseDirectiveDefinition() error {
+	if err := p.expectPunct("@"); err != nil {
+		return err
+	}
+	if _, err := p.expectName(); err != nil {
+		return err
+	}
+	if p.isPunct("(") {
+		if err := p.skipBalanced("(", ")"); err != nil {
+			return err
+		}
+	}
+	if p.peek().Kind == sdlName && p.peek().Value == "repeatable" {
+		p.pos++
+	}
+	if tok := p.next(); tok.Kind != sdlName || tok.Value != "on" {
+		return fmt.Errorf("expected \"on\" on line %d, got %q", tok.Line, tok.Value)
+	}
+	_, err := p.parseNameList()
+	return err
+}
+
+func (p *sdlParser) parseDefinition() error {
+	p.skipDescription()
+	keyword, err := p.expectName()
+	if err != nil {
+		return err
+	}
+	if keyword == "extend" {
+		keyword, err = p.expectName()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch keyword {
+	case "schema":
+		if err := p.skipDirectives(); err != nil {
+			return err
+		}
+		if p.isPunct("{") {
+			return p.skipBalanced("{", "}")
+		}
+		return nil
+	case "directive":
+		return p.parseDirectiveDefinition()
+	}
+
+	name, err := p.expectName()
+	if err != nil {
+		return err
+	}
+
+	switch keyword {
+	case "scalar":
+		p.typeNamed(name, "SCALAR")
+		return p.skipDirectives()
+	case "type", "interface":
+		kind := "OBJECT"
+		if keyword == "interface" {
+			kind = "INTERFACE"
+		}
+		typ := p.typeNamed(name, kind)
+		interfaces, err := p.parseImplements()
+		if err != nil {
+			return err
+		}
+		typ.Interfaces = append(typ.Interfaces, interfaces...)
+		if err := p.skipDirectives(); err != nil {
+			return err
+		}
+		fields, err := p.parseFields(false)
+		if err != nil {
+			return err
+		}
+		typ.Fields = append(typ.Fields, fields...)
+	case "input":
+		typ := p.typeNamed(name, "INPUT_OBJECT")
+		if err := p.skipDirectives(); err != nil {
+			return err
+		}
+		fields, err := p.parseFields(true)
+		if err != nil {
+			return err
+		}
+		typ.Fields = append(typ.Fields, fields...)
+	case "union":
+		typ := p.typeNamed(name, "UNION")
+		if err := p.skipDirectives(); err != nil {
+			return err
+		}
+		if !p.skipPunct("=") {
+			return nil
+		}
+		members, err := p.parseNameList()
+		if err != nil {
+			return err
+		}
+		typ.Members = append(typ.Members, members...)
+	case "enum":
+		p.typeNamed(name, "ENUM")
+		if err := p.skipDirectives(); err != nil {
+			return err
+		}
+		return p.parseEnumValues()
+	default:
+		return fmt.Errorf("unsupported definition %q", keyword)
+	}
+	return nil
+}
+
+// parseSDL reads a GraphQL SDL document into the introspection representation
+// used by buildFieldDictFromTypes
+func parseSDL(src string) ([]IntrospectionType, error) {
+	tokens, err := sdlTokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &sdlParser{tokens: tokens, types: make(map[string]*sdlType)}
+	for _, name := range sdlBuiltinScalars {
+		p.typeNamed(name, "SCALAR")
+	}
+	for p.peek().Kind != sdlEOF {
+		if err := p.parseDefinition(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Like introspection, the possible types of an interface are the object
+	// types implementing it
+	implementations := make(map[string][]string)
+	for _, name := range p.order {
+		if p.types[name].Kind != "OBJECT" {
+			continue
+		}
+		for _, iface := range p.types[name].Interfaces {
+			implementations[iface] = append(implementations[iface], name)
+		}
+	}
+
+	var resolveRef func(ref *sdlTypeRef) (IntrospectionFieldTypeDef, error)
+	resolveRef = func(ref *sdlTypeRef) (IntrospectionFieldTypeDef, error) {
+		if ref.Kind != "" {
+			ofType, err := resolveRef(ref.OfType)
+			if err != nil {
+				return IntrospectionFieldTypeDef{}, err
+			}
+			return IntrospectionFieldTypeDef{Kind: ref.Kind, OfType: &ofType}, nil
+		}
+		typ, exists := p.types[ref.Name]
+		if !exists || typ.Kind == "" {
+			return IntrospectionFieldTypeDef{}, fmt.Errorf("undefined type %q", ref.Name)
+		}
+		return IntrospectionFieldTypeDef{Name: typ.Name, Kind: typ.Kind}, nil
+	}
+
+	types := []IntrospectionType{}
+	for _, name := range p.order {
+		typ := p.types[name]
+		introspectionType := IntrospectionType{Name: typ.Name, Kind: typ.Kind}
+
+		if typ.Kind == "OBJECT" || typ.Kind == "INTERFACE" {
+			introspectionType.Fields = []IntrospectionField{}
+			for _, field := range typ.Fields {
+				fieldType, err := resolveRef(field.Type)
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %w", typ.Name, field.Name, err)
+				}
+				introspectionType.Fields = append(introspectionType.Fields, IntrospectionField{Name: field.Name, Type: fieldType})
+			}
+		}
+
+		possibleTypes := typ.Members
+		if typ.Kind == "INTERFACE" {
+			possibleTypes = implementations[typ.Name]
+		}
+		for _, member := range possibleTypes {
+			memberType, exists := p.types[member]
+			if !exists {
+				return nil, fmt.Errorf("%s: undefined possible type %q", typ.Name, member)
+			}
+			introspectionType.PossibleTypes = append(introspectionType.PossibleTypes, IntrospectionPossibleType{Name: member, Kind: memberType.Kind})
+		}
+
+		types = append(types, introspectionType)
+	}
+
+	return types, nil
+}
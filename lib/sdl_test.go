@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testSDL = `"""
+The schema of the \""" test \""" server
+"""
+schema @link(url: "https://example.org") { query: Query }
+
+directive @cost(weight: Int = 1, tags: [String] = ["a", "b"]) repeatable on FIELD_DEFINITION | OBJECT
+
+# Dates are strings
+scalar Date @specifiedBy(url: "https://example.org/date")
+
+"A resource"
+interface Resource {
+  id: ID!
+}
+
+interface DomainResource implements Resource @cost {
+  id: ID!
+  "Narrative" text: String
+}
+
+type Patient implements & Resource & DomainResource @cost(weight: 2) {
+  id: ID!
+  text: String @cost(tags: ["narrative"])
+  """
+  Names, with "quotes" and \"""
+  """
+  name(_count: Int = 10, filter: NameFilter = {use: official, family: ["a"]}): [HumanName!]!
+  birthDate: Date
+  matrix: [[Int!]]
+}
+
+type HumanName {
+  family: String
+  given: [String]
+  use: NameUse
+}
+
+extend type Patient @cost {
+  gender: NameUse
+}
+
+union ResourceUnion @cost = | Patient | HumanName
+
+enum NameUse {
+  "Official" official
+  old @deprecated(reason: "use official")
+}
+
+input NameFilter {
+  use: NameUse = official
+  family: [String!] = ["a"] @cost
+}
+
+type Query {
+  Patient(id: ID!): Patient
+  PatientList(name: String = "x, \"y\"", _count: Int = -1, score: Float = 1.5e3, ids: [ID] = $ids): [Patient]
+}
+`
+
+// testIntrospection is the introspection response for testSDL
+const testIntrospection = `{"data":{"__schema":{"types":[
+  {"name":"Int","kind":"SCALAR","possibleTypes":null,"fields":null},
+  {"name":"Float","kind":"SCALAR","possibleTypes":null,"fields":null},
+  {"name":"String","kind":"SCALAR","possibleTypes":null,"fields":null},
+  {"name":"Boolean","kind":"SCALAR","possibleTypes":null,"fields":null},
+  {"name":"ID","kind":"SCALAR","possibleTypes":null,"fields":null},
+  {"name":"Date","kind":"SCALAR","possibleTypes":null,"fields":null},
+  {"name":"Resource","kind":"INTERFACE","possibleTypes":[{"name":"Patient","kind":"OBJECT"}],"fields":[
+    {"name":"id","type":{"name":null,"kind":"NON_NULL","ofType":{"name":"ID","kind":"SCALAR","ofType":null}}}
+  ]},
+  {"name":"DomainResource","kind":"INTERFACE","possibleTypes":[{"name":"Patient","kind":"OBJECT"}],"fields":[
+    {"name":"id","type":{"name":null,"kind":"NON_NULL","ofType":{"name":"ID","kind":"SCALAR","ofType":null}}},
+    {"name":"text","type":{"name":"String","kind":"SCALAR","ofType":null}}
+  ]},
+  {"name":"Patient","kind":"OBJECT","possibleTypes":null,"fields":[
+    {"name":"id","type":{"name":null,"kind":"NON_NULL","ofType":{"name":"ID","kind":"SCALAR","ofType":null}}},
+    {"name":"text","type":{"name":"String","kind":"SCALAR","ofType":null}},
+    {"name":"name","type":{"name":null,"kind":"NON_NULL","ofType":{"name":null,"kind":"LIST","ofType":{"name":null,"kind":"NON_NULL","ofType":{"name":"HumanName","kind":"OBJECT"}}}}},
+    {"name":"birthDate","type":{"name":"Date","kind":"SCALAR","ofType":null}},
+    {"name":"matrix","type":{"name":null,"kind":"LIST","ofType":{"name":null,"kind":"LIST","ofType":{"name":null,"kind":"NON_NULL","ofType":{"name":"Int","kind":"SCALAR"}}}}},
+    {"name":"gender","type":{"name":"NameUse","kind":"ENUM","ofType":null}}
+  ]},
+  {"name":"HumanName","kind":"OBJECT","possibleTypes":null,"fields":[
+    {"name":"family","type":{"name":"String","kind":"SCALAR","ofType":null}},
+    {"name":"given","type":{"name":null,"kind":"LIST","ofType":{"name":"String","kind":"SCALAR","ofType":null}}},
+    {"name":"use","type":{"name":"NameUse","kind":"ENUM","ofType":null}}
+  ]},
+  {"name":"ResourceUnion","kind":"UNION","possibleTypes":[{"name":"Patient","kind":"OBJECT"},{"name":"HumanName","kind":"OBJECT"}],"fields":null},
+  {"name":"NameUse","kind":"ENUM","possibleTypes":null,"fields":null},
+  {"name":"NameFilter","kind":"INPUT_OBJECT","possibleTypes":null,"fields":null},
+  {"name":"Query","kind":"OBJECT","possibleTypes":null,"fields":[
+    {"name":"Patient","type":{"name":"Patient","kind":"OBJECT","ofType":null}},
+    {"name":"PatientList","type":{"name":null,"kind":"LIST","ofType":{"name":"Patient","kind":"OBJECT","ofType":null}}}
+  ]},
+  {"name":"__Schema","kind":"OBJECT","possibleTypes":null,"fields":[
+    {"name":"types","type":{"name":null,"kind":"NON_NULL","ofType":{"name":null,"kind":"LIST","ofType":{"name":"__Type","kind":"OBJECT"}}}}
+  ]}
+]}}}`
+
+func TestParseSDLMatchesIntrospection(t *testing.T) {
+	types, err := parseSDL(testSDL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromSDL := buildFieldDictFromTypes(types)
+
+	fromIntrospection, err := buildFieldDict([]byte(testIntrospection))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fromSDL, fromIntrospection) {
+		for name, typ := range fromIntrospection {
+			if !reflect.DeepEqual(fromSDL[name], typ) {
+				t.Errorf("%s: got %+v, expected %+v", name, fromSDL[name], typ)
+			}
+		}
+		for name := range fromSDL {
+			if _, ok := fromIntrospection[name]; !ok {
+				t.Errorf("unexpected type %s", name)
+			}
+		}
+	}
+}
+
+func TestParseSDLTypeRefs(t *testing.T) {
+	types, err := parseSDL(testSDL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		field  string
+		expect string
+	}{
+		{"id", `{"name":"","kind":"NON_NULL","ofType":{"name":"ID","kind":"SCALAR"}}`},
+		{"name", `{"name":"","kind":"NON_NULL","ofType":{"name":"","kind":"LIST","ofType":{"name":"","kind":"NON_NULL","ofType":{"name":"HumanName","kind":"OBJECT"}}}}`},
+		{"birthDate", `{"name":"Date","kind":"SCALAR"}`},
+		{"matrix", `{"name":"","kind":"LIST","ofType":{"name":"","kind":"LIST","ofType":{"name":"","kind":"NON_NULL","ofType":{"name":"Int","kind":"SCALAR"}}}}`},
+	}
+
+	fields := map[string]IntrospectionFieldTypeDef{}
+	for _, typ := range types {
+		if typ.Name == "Patient" {
+			for _, field := range typ.Fields {
+				fields[field.Name] = field.Type
+			}
+		}
+	}
+	for _, test := range tests {
+		t.Run(test.field, func(t *testing.T) {
+			got, _ := json.Marshal(fields[test.field])
+			if string(got) != test.expect {
+				t.Errorf("got %s, expected %s", got, test.expect)
+			}
+		})
+	}
+}
+
+func TestSDLTokenizeStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		expect []string
+		err    string
+	}{
+		{"string", `"a b"`, []string{"a b"}, ""},
+		{"escaped quote", `"a \"b\""`, []string{`a \"b\"`}, ""},
+		{"block string", `"""a "b" c"""`, []string{`a "b" c`}, ""},
+		{"escaped block quote", `"""a \""" b"""`, []string{`a \""" b`}, ""},
+		{"escaped block quote at the end", `"""a \""""""`, []string{`a \"""`}, ""},
+		{"block strings in a row", `"""a""" """b"""`, []string{"a", "b"}, ""},
+		{"multiline block string", "\"\"\"\na\n\"\"\"", []string{"\na\n"}, ""},
+		{"unterminated block string", `"""a \"""`, nil, "unterminated block string on line 1"},
+		{"unterminated string", `"a`, nil, "unterminated string on line 1"},
+		{"string across lines", "\"a\nb\"", nil, "unterminated string on line 1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens, err := sdlTokenize(test.src)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, expected %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var values []string
+			for _, tok := range tokens {
+				if tok.Kind == sdlString {
+					values = append(values, tok.Value)
+				}
+			}
+			if !reflect.DeepEqual(values, test.expect) {
+				t.Errorf("got %q, expected %q", values, test.expect)
+			}
+		})
+	}
+}
+
+func TestSDLTokenizeLines(t *testing.T) {
+	tokens, err := sdlTokenize("\"\"\"\ndescription\n\"\"\"\ntype A {\n  b: Int # comment\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := map[string]int{}
+	for _, tok := range tokens {
+		if tok.Kind == sdlName {
+			lines[tok.Value] = tok.Line
+		}
+	}
+	if expect := map[string]int{"type": 4, "A": 4, "b": 5, "Int": 5}; !reflect.DeepEqual(lines, expect) {
+		t.Errorf("got %v, expected %v", lines, expect)
+	}
+}
+
+func TestParseSDLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"undefined field type", "type A { b: B }", `A.b: undefined type "B"`},
+		{"undefined union member", "union U = A", `U: undefined possible type "A"`},
+		{"unsupported definition", "query Q { a }", `unsupported definition "query"`},
+		{"missing field type", "type A {\n  b\n}", `expected ":" on line 3, got "}"`},
+		{"unclosed list type", "type A { b: [Int }", `expected "]" on line 1, got "}"`},
+		{"unbalanced arguments", "type A { b(c: Int: Int }", `unbalanced "("`},
+		{"directive without locations", "directive @a(b: Int) FIELD", `expected "on" on line 1, got "FIELD"`},
+		{"unexpected character", "type A { b: Int% }", `unexpected character '%' on line 1`},
+		{"missing default value", "input A { b: Int = }", `expected value on line 1, got "}"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseSDL(test.src)
+			if err == nil || err.Error() != test.err {
+				t.Errorf("got error %v, expected %s", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+// Search parameters that apply to all resource types and are passed on in a
+// system-wide search. Other "_" parameters are result parameters.
+var commonSearchParams = []string{
+	"_id",
+	"_lastUpdated",
+	"_tag",
+	"_profile",
+	"_security",
+	"_source",
+	"_text",
+	"_content",
+	"_list",
+	"_has",
+	"_language",
+}
+
+// searchableTypes returns the resource types that have a connection field on
+// the Query type
+func searchableTypes(schemaDict map[string]gql.SchemaType) []string {
+	var types []string
+	for _, field := range schemaDict["Query"].Fields {
+		resourceType, isConnection := strings.CutSuffix(field.Name, "Connection")
+		if !isConnection {
+			continue
+		}
+		if _, exists := schemaDict[resourceType]; exists {
+			types = append(types, resourceType)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// fhirSystemSearch searches across the resource types in _type, or all
+// searchable types, with a single aliased GraphQL query. The same search
+// arguments go to every type, so without _type only the common parameters
+// are accepted.
+func fhirSystemSearch(w http.ResponseWriter, req *http.Request) {
+	schema := TenantFromRequest(req).Schema
+	queryString := req.URL.Query()
+	profile := queryString.Get("_profile")
+
+	available := searchableTypes(schema)
+	resourceTypes := available
+	typeParams, typed := queryString["_type"]
+	if typed {
+		resourceTypes = nil
+		for _, typeParam := range typeParams {
+			for _, resourceType := range strings.Split(typeParam, ",") {
+				resourceType = strings.TrimSpace(resourceType)
+				if resourceType == "" {
+					continue
+				}
+				if !containsString(available, resourceType) {
+					SendError(w, fmt.Sprintf("unknown resource type: %s", resourceType), http.StatusBadRequest)
+					return
+				}
+				resourceTypes = appendUnique(resourceTypes, resourceType)
+			}
+		}
+	}
+	if len(resourceTypes) == 0 {
+		SendError(w, "No resource types to search", http.StatusBadRequest)
+		return
+	}
+
+	var searchParams = make(gql.Arguments)
+	for key, values := range queryString {
+		commonParam := containsString(commonSearchParams, key)
+		if strings.HasPrefix(key, "_") && !commonParam {
+			continue
+		}
+		if !typed && !commonParam {
+			SendError(w, fmt.Sprintf("Search parameter %s requires _type", key), http.StatusBadRequest)
+			return
+		}
+		// A search argument holds one value, repeating a parameter would
+		// drop the others
+		if len(values) > 1 {
+			SendError(w, fmt.Sprintf("Repeated search parameter %s is not supported", key), http.StatusBadRequest)
+			return
+		}
+		searchParams[key] = gql.ArgumentValue{Value: values[0]}
+	}
+
+	fragments := make(map[string]gql.Fragment)
+	gqlStr := ""
+	for _, resourceType := range resourceTypes {
+		fragments[resourceType] = GenerateFragment(schema, resourceType)
+		gqlStr += fragments[resourceType].String() + "\n"
+	}
+
+	query := SystemSearchRequest(resourceTypes, searchParams, fragments)
+	gqlStr += query.String()
+
+	sendSearchResult(w, req, gqlStr, profile)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fhirrtg/fhirrtg/gql"
+)
+
+type ctxTenantKey struct{}
+
+// Tenant is one upstream FHIR GraphQL server fronted by fhirrtg. Requests
+// without a tenant path segment use the default tenant.
+type Tenant struct {
+	Name       string            `json:"-"`
+	Upstream   string            `json:"upstream"`
+	SchemaFile string            `json:"schemaFile,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	OAuth2     *oauth2Config     `json:"oauth2,omitempty"`
+
+	Schema     map[string]gql.SchemaType `json:"-"`
+	schemaHash string
+	proxy      *httputil.ReverseProxy
+
+	// Set once the schema is loaded, Schema is not read before
+	schemaReady atomic.Bool
+	// Time of the next introspection attempt in Unix nanoseconds
+	nextAttempt atomic.Int64
+}
+
+var validTenantName = regexp.MustCompile(`^[A-Za-z0-9\-_.]+$`)
+
+func newTenant(name string, upstreamURL string, schemaFile string, headers map[string]string) (*Tenant, error) {
+	tenant := &Tenant{
+		Name:       name,
+		Upstream:   upstreamURL,
+		SchemaFile: schemaFile,
+		Headers:    headers,
+	}
+	proxy, err := newUpstreamProxy(tenant)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream server URL for tenant %q: %s", name, upstreamURL)
+	}
+	tenant.proxy = proxy
+	return tenant, nil
+}
+
+// loadTenants reads the tenants file, a JSON object keyed by tenant name:
+//
+//	{"acme": {"upstream": "https://acme/fhir", "schemaFile": "acme.graphql", "headers": {"X-Api-Key": "..."},
+//	          "oauth2": {"tokenUrl": "https://auth/token", "clientId": "rtg", "clientSecret": "..."}}}
+func loadTenants(path string) (map[string]*Tenant, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants file %s: %w", path, err)
+	}
+
+	var configs map[string]*Tenant
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants file %s: %w", path, err)
+	}
+
+	tenants := make(map[string]*Tenant)
+	for name, config := range configs {
+		if !validTenantName.MatchString(name) {
+			return nil, fmt.Errorf("invalid tenant name: %q", name)
+		}
+		if config == nil || config.Upstream == "" {
+			return nil, fmt.Errorf("no upstream server specified for tenant %q", name)
+		}
+		tenant, err := newTenant(name, config.Upstream, config.SchemaFile, config.Headers)
+		if err != nil {
+			return nil, err
+		}
+		if config.OAuth2 != nil {
+			if err := config.OAuth2.validate(); err != nil {
+				return nil, fmt.Errorf("tenant %q: %w", name, err)
+			}
+			tenant.OAuth2 = config.OAuth2
+		}
+		tenants[name] = tenant
+	}
+	return tenants, nil
+}
+
+// allTenants returns the default tenant (if configured) followed by the named
+// tenants in name order
+func allTenants() []*Tenant {
+	var all []*Tenant
+	if defaultTenant != nil {
+		all = append(all, defaultTenant)
+	}
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		all = append(all, tenants[name])
+	}
+	return all
+}
+
+func (t *Tenant) String() string {
+	if t.Name == "" {
+		return t.Upstream
+	}
+	return fmt.Sprintf("%s (%s)", t.Name, t.Upstream)
+}
+
+func (t *Tenant) UpstreamBase() string {
+	return strings.TrimSuffix(t.Upstream, "/")
+}
+
+// setHeaders adds the tenant's fixed headers to an upstream request
+func (t *Tenant) setHeaders(header http.Header) {
+	for name, value := range t.Headers {
+		header.Set(name, value)
+	}
+}
+
+// loadSchema loads the tenant's schema from its schema file, or by
+// introspecting its upstream server
+func (t *Tenant) loadSchema() error {
+	if t.SchemaFile != "" {
+		schema, err := loadSchemaFile(t.SchemaFile)
+		if err != nil {
+			return err
+		}
+		t.Schema = schema
+		t.schemaHash = schemaHash(schema)
+		t.schemaReady.Store(true)
+		observeSchema(t, false)
+		return nil
+	}
+	if err := introspect(t); err != nil {
+		return err
+	}
+	t.schemaHash = schemaHash(t.Schema)
+	t.schemaReady.Store(true)
+	observeSchema(t, true)
+	return nil
+}
+
+// currentSchema returns the loaded schema and its hash, or nil while the
+// schema is not loaded yet
+func (t *Tenant) currentSchema() (map[string]gql.SchemaType, string) {
+	if !t.schemaReady.Load() {
+		return nil, ""
+	}
+	return t.Schema, t.schemaHash
+}
+
+// retryAfter returns the seconds until the next introspection attempt, at
+// least one
+func (t *Tenant) retryAfter() int {
+	wait := time.Until(time.Unix(0, t.nextAttempt.Load()))
+	if wait < time.Second {
+		return 1
+	}
+	return int((wait + time.Second - 1) / time.Second)
+}
+
+func withTenant(req *http.Request, tenant *Tenant) *http.Request {
+	ctx := context.WithValue(req.Context(), ctxTenantKey{}, tenant)
+	return req.WithContext(ctx)
+}
+
+// TenantFromRequest returns the tenant selected for req by dispatch, or the
+// default tenant
+func TenantFromRequest(r *http.Request) *Tenant {
+	if r != nil {
+		if t, ok := r.Context().Value(ctxTenantKey{}).(*Tenant); ok {
+			return t
+		}
+	}
+	return defaultTenant
+}
+
+// trimPathPrefix strips prefix from path if path is prefix or continues with
+// a "/" after it
+func trimPathPrefix(path string, prefix string) (string, bool) {
+	if prefix == "" {
+		return path, true
+	}
+	if path == prefix {
+		return "/", true
+	}
+	if strings.HasPrefix(path, prefix+"/") {
+		return strings.TrimPrefix(path, prefix), true
+	}
+	return path, false
+}
+
+// routeRequest selects the tenant from an optional leading tenant segment and
+// strips the tenant and base path prefixes from the request path. A nil
+// tenant means no upstream serves this path.
+func routeRequest(req *http.Request) (*http.Request, *Tenant) {
+	path := req.URL.Path
+	tenant := defaultTenant
+	prefix := ""
+
+	if len(tenants) > 0 {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		if t, exists := tenants[segment]; exists {
+			tenant = t
+			prefix = "/" + segment
+			path, _ = trimPathPrefix(path, prefix)
+		}
+	}
+
+	if trimmed, found := trimPathPrefix(path, BASE_PATH); found && BASE_PATH != "" {
+		path = trimmed
+		prefix += BASE_PATH
+	}
+
+	req.URL.Path = path
+	req.URL.RawPath = ""
+	if prefix != "" {
+		req = withBasePath(req, prefix)
+	}
+	if tenant != nil {
+		req = withTenant(req, tenant)
+	}
+	return req, tenant
+}
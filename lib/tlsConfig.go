@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often certificate files are checked for changes
+const CERT_RELOAD_INTERVAL = 10 * time.Second
+
+// Client certificate modes of the listener
+const (
+	CLIENT_AUTH_REQUIRE  = "require"
+	CLIENT_AUTH_OPTIONAL = "optional"
+)
+
+// reloadingFiles caches a value loaded from files and loads it again once
+// one of the files has changed. A failed reload keeps the previous value and
+// is retried on the next check.
+type reloadingFiles[T any] struct {
+	files []string
+	load  func() (T, error)
+
+	mu      sync.Mutex
+	value   T
+	modTime time.Time
+	checked time.Time
+}
+
+func newReloadingFiles[T any](load func() (T, error), files ...string) (*reloadingFiles[T], error) {
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r := &reloadingFiles[T]{files: files, load: load, value: value, checked: time.Now()}
+	r.modTime = r.latestModTime()
+	return r, nil
+}
+
+func (r *reloadingFiles[T]) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range r.files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// Get returns the current value, checking the files at most every
+// CERT_RELOAD_INTERVAL
+func (r *reloadingFiles[T]) Get() T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < CERT_RELOAD_INTERVAL {
+		return r.value
+	}
+	r.checked = time.Now()
+	modTime := r.latestModTime()
+	if !modTime.After(r.modTime) {
+		return r.value
+	}
+
+	value, err := r.load()
+	if err != nil {
+		log.Error("Failed to reload certificate files", "files", r.files, "error", err)
+		return r.value
+	}
+	r.value = value
+	r.modTime = modTime
+	log.Info("Reloaded certificate files", "files", r.files)
+	return r.value
+}
+
+func loadCertificate(certFile string, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate %s: %w", certFile, err)
+	}
+	return &cert, nil
+}
+
+// loadCertPool reads a PEM CA bundle, on top of the system roots if
+// withSystem is set
+func loadCertPool(file string, withSystem bool) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s: %w", file, err)
+	}
+	pool := x509.NewCertPool()
+	if withSystem {
+		if systemPool, err := x509.SystemCertPool(); err == nil {
+			pool = systemPool
+		}
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in CA bundle %s", file)
+	}
+	return pool, nil
+}
+
+// upstreamTLSConfig returns the TLS settings for upstream connections. The
+// client certificate is reloaded when its files change.
+func upstreamTLSConfig(skipVerify bool, caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: skipVerify,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile, true)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := newReloadingFiles(func() (*tls.Certificate, error) {
+			return loadCertificate(certFile, keyFile)
+		}, certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.Get(), nil
+		}
+	}
+	return config, nil
+}
+
+// listenerTLSConfig returns the TLS settings of the listener. With a client
+// CA bundle, clients authenticate with certificates (mutual TLS). The
+// certificate and the client CA bundle are reloaded when their files change.
+func listenerTLSConfig(certFile string, keyFile string, clientCAFile string, clientAuth string) (*tls.Config, error) {
+	cert, err := newReloadingFiles(func() (*tls.Certificate, error) {
+		return loadCertificate(certFile, keyFile)
+	}, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.Get(), nil
+		},
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	var authType tls.ClientAuthType
+	switch clientAuth {
+	case CLIENT_AUTH_REQUIRE:
+		authType = tls.RequireAndVerifyClientCert
+	case CLIENT_AUTH_OPTIONAL:
+		authType = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid client certificate mode: %s", clientAuth)
+	}
+	clientCAs, err := newReloadingFiles(func() (*x509.CertPool, error) {
+		return loadCertPool(clientCAFile, false)
+	}, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	base := config.Clone()
+	base.ClientAuth = authType
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		clientConfig := base.Clone()
+		clientConfig.ClientCAs = clientCAs.Get()
+		return clientConfig, nil
+	}
+	return config, nil
+}
+
+// clientIdentity is what a client certificate is mapped to. With a scope the
+// certificate authorizes requests like a bearer token with that scope.
+type clientIdentity struct {
+	Subject string `json:"subject"`
+	Scope   string `json:"scope,omitempty"`
+	Patient string `json:"patient,omitempty"`
+}
+
+// loadClientIdentities reads the client certificate mapping, a JSON object
+// keyed by certificate name:
+//
+//	{"billing.example.org": {"subject": "billing", "scope": "system/Claim.cruds"}}
+func loadClientIdentities(path string) (map[string]clientIdentity, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client identity file %s: %w", path, err)
+	}
+	var identities map[string]clientIdentity
+	if err := json.Unmarshal(content, &identities); err != nil {
+		return nil, fmt.Errorf("failed to parse client identity file %s: %w", path, err)
+	}
+	for name, identity := range identities {
+		if identity.Subject == "" {
+			identity.Subject = name
+			identities[name] = identity
+		}
+	}
+	return identities, nil
+}
+
+// certificateNames returns the names a client certificate is mapped by: its
+// DNS, email and URI subject alternative names, then its common name
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// withClientIdentity adds the identity of a verified client certificate to
+// the request logger and, if it has a scope, authorizes the request with it
+func withClientIdentity(req *http.Request) *http.Request {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return req
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+
+	identity := clientIdentity{Subject: cert.Subject.CommonName}
+	for _, name := range certificateNames(cert) {
+		if mapped, exists := TLS_CLIENT_IDENTITIES[name]; exists {
+			identity = mapped
+			break
+		}
+	}
+
+	ctx := context.WithValue(req.Context(), ctxLoggerKey{}, LoggerFromRequest(req).With("client", identity.Subject))
+	if identity.Scope != "" && req.Header.Get("Authorization") == "" {
+		ctx = context.WithValue(ctx, ctxAuthKey{}, &authContext{
+			Subject: identity.Subject,
+			Patient: identity.Patient,
+			Scopes:  parseScopes(identity.Scope),
+		})
+	}
+	return req.WithContext(ctx)
+}
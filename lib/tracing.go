@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing with W3C trace context, see https://www.w3.org/TR/trace-context/,
+// and export to an OpenTelemetry collector with OTLP/HTTP JSON
+
+const (
+	TRACEPARENT_HEADER = "traceparent"
+	TRACESTATE_HEADER  = "tracestate"
+
+	OTLP_TRACES_PATH = "/v1/traces"
+	OTLP_TIMEOUT     = 10 * time.Second
+
+	// Spans are sent in batches of up to TRACE_BATCH_SIZE, at least every
+	// TRACE_EXPORT_INTERVAL. Spans beyond TRACE_QUEUE_SIZE are dropped.
+	TRACE_BATCH_SIZE      = 512
+	TRACE_QUEUE_SIZE      = 2048
+	TRACE_EXPORT_INTERVAL = 5 * time.Second
+)
+
+// OTLP span kinds
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_SERVER   = 2
+	SPAN_KIND_CLIENT   = 3
+)
+
+type ctxSpanKey struct{}
+
+// span is a timed operation of a trace
+type span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	TraceState string
+	Sampled    bool
+
+	Name      string
+	Kind      int
+	StartTime time.Time
+	EndTime   time.Time
+
+	mu         sync.Mutex
+	attributes []spanAttribute
+	errorMsg   string
+	ended      bool
+}
+
+type spanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+func randomHex(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func isHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil && strings.ToLower(value) == value && strings.Trim(value, "0") != ""
+}
+
+// parseTraceparent reads the parent span of a traceparent header. Headers of
+// unknown versions are read as version 00.
+func parseTraceparent(header string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return nil, false
+	}
+	if !isHex(parts[1], 32) || !isHex(parts[2], 16) || len(parts[3]) != 2 {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	return &span{TraceID: parts[1], SpanID: parts[2], Sampled: flags&1 == 1}, true
+}
+
+// traceparent formats the header that makes s the parent of a downstream span
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+// newSpan starts a child of parent, or the root span of a new trace. New
+// traces are sampled when an OTLP endpoint is configured.
+func newSpan(parent *span, name string, kind int) *span {
+	s := &span{SpanID: randomHex(8), Name: name, Kind: kind, StartTime: time.Now()}
+	if parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+		s.TraceState = parent.TraceState
+		s.Sampled = parent.Sampled
+	} else {
+		s.TraceID = randomHex(16)
+		s.Sampled = OTLP_ENDPOINT != ""
+	}
+	return s
+}
+
+// startServerSpan starts the span of an inbound request, continuing the
+// trace of its traceparent header
+func startServerSpan(req *http.Request) *span {
+	parent, _ := parseTraceparent(req.Header.Get(TRACEPARENT_HEADER))
+	if parent != nil {
+		parent.TraceState = req.Header.Get(TRACESTATE_HEADER)
+	}
+	s := newSpan(parent, req.Method, SPAN_KIND_SERVER)
+	s.SetAttributes(
+		"http.request.method", req.Method,
+		"url.path", req.URL.Path,
+		"user_agent.original", req.UserAgent(),
+		"client.address", clientIP(req),
+	)
+	return s
+}
+
+func SpanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(ctxSpanKey{}).(*span)
+	return s
+}
+
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	return context.WithValue(ctx, ctxSpanKey{}, s)
+}
+
+// startSpan starts a child of the span in ctx and returns a context with the
+// new span
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s := newSpan(SpanFromContext(ctx), name, kind)
+	return contextWithSpan(ctx, s), s
+}
+
+// SetAttributes adds key value pairs to the span
+func (s *span) SetAttributes(keyValues ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		if key, ok := keyValues[i].(string); ok {
+			s.attributes = append(s.attributes, spanAttribute{key, keyValues[i+1]})
+		}
+	}
+}
+
+// SetError marks the span as failed
+func (s *span) SetError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorMsg = msg
+}
+
+// End ends the span and queues it for export if it is sampled
+func (s *span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	if !s.Sampled {
+		return
+	}
+	traceMu.RLock()
+	defer traceMu.RUnlock()
+	if traceQueue == nil {
+		return
+	}
+	select {
+	case traceQueue <- s:
+	default:
+		log.Warn("Trace queue full, span dropped", "span", s.Name)
+	}
+}
+
+// injectTraceContext sets the trace headers for an upstream request made
+// within the span in ctx
+func injectTraceContext(ctx context.Context, header http.Header) {
+	s := SpanFromContext(ctx)
+	if s == nil {
+		header.Del(TRACEPARENT_HEADER)
+		header.Del(TRACESTATE_HEADER)
+		return
+	}
+	header.Set(TRACEPARENT_HEADER, s.traceparent())
+	if s.TraceState != "" {
+		header.Set(TRACESTATE_HEADER, s.TraceState)
+	} else {
+		header.Del(TRACESTATE_HEADER)
+	}
+}
+
+var (
+	traceQueue chan *span
+	traceMu    sync.RWMutex
+	traceDone  sync.WaitGroup
+	otlpClient = &http.Client{Timeout: OTLP_TIMEOUT}
+)
+
+// otlpTracesURL returns the traces URL of an OTLP/HTTP endpoint, which may be
+// given with or without the /v1/traces path
+func otlpTracesURL(endpoint string) string {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if strings.HasSuffix(endpoint, OTLP_TRACES_PATH) {
+		return endpoint
+	}
+	return endpoint + OTLP_TRACES_PATH
+}
+
+// startTraceExporter sends finished spans to the OTLP endpoint in batches
+func startTraceExporter() {
+	if OTLP_ENDPOINT == "" {
+		return
+	}
+	queue := make(chan *span, TRACE_QUEUE_SIZE)
+	traceQueue = queue
+	traceDone.Add(1)
+	go func() {
+		defer traceDone.Done()
+		ticker := time.NewTicker(TRACE_EXPORT_INTERVAL)
+		defer ticker.Stop()
+
+		var batch []*span
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := exportSpans(batch); err != nil {
+				log.Error("Failed to export spans", "spans", len(batch), "error", err)
+			}
+			batch = nil
+		}
+		for {
+			select {
+			case s, open := <-queue:
+				if !open {
+					flush()
+					return
+				}
+				batch = append(batch, s)
+				if len(batch) >= TRACE_BATCH_SIZE {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+// stopTraceExporter waits for the queued spans to be exported
+func stopTraceExporter() {
+	traceMu.Lock()
+	queue := traceQueue
+	traceQueue = nil
+	traceMu.Unlock()
+	if queue != nil {
+		close(queue)
+		traceDone.Wait()
+	}
+}
+
+func exportSpans(spans []*span) error {
+	body, err := json.Marshal(otlpTraces(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, otlpTracesURL(OTLP_ENDPOINT), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range OTLP_HEADERS {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := otlpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// parseOTLPHeaders reads the extra headers for the OTLP endpoint, a comma
+// separated list of name=value pairs
+func parseOTLPHeaders(spec string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, value, found := strings.Cut(item, "=")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid OTLP header: %s", item)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// otlpValue encodes an attribute value as an OTLP AnyValue
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+}
+
+func otlpAttributes(attributes []spanAttribute) []interface{} {
+	encoded := []interface{}{}
+	for _, attribute := range attributes {
+		encoded = append(encoded, map[string]interface{}{
+			"key":   attribute.Key,
+			"value": otlpValue(attribute.Value),
+		})
+	}
+	return encoded
+}
+
+// otlpTraces encodes spans as an OTLP ExportTraceServiceRequest
+func otlpTraces(spans []*span) map[string]interface{} {
+	var encoded []interface{}
+	for _, s := range spans {
+		s.mu.Lock()
+		status := map[string]interface{}{"code": 0}
+		if s.errorMsg != "" {
+			status = map[string]interface{}{"code": 2, "message": s.errorMsg}
+		}
+		otlpSpan := map[string]interface{}{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+			"status":            status,
+		}
+		if s.ParentID != "" {
+			otlpSpan["parentSpanId"] = s.ParentID
+		}
+		if s.TraceState != "" {
+			otlpSpan["traceState"] = s.TraceState
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, otlpSpan)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes([]spanAttribute{
+						{"service.name", OTLP_SERVICE_NAME},
+						{"service.version", VERSION},
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "fhirrtg", "version": VERSION},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers never copied to the upstream. They describe the inbound
+// connection or body, not the request.
+var connectionHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Host",
+	"Content-Length",
+	"Accept-Encoding",
+}
+
+// forwardHeader reports whether an inbound header may be sent to the
+// upstream of tenant
+func forwardHeader(tenant *Tenant, name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if containsString(connectionHeaders, name) || containsString(DROP_HEADERS, name) {
+		return false
+	}
+	if name == "Authorization" {
+		// Upstream credentials replace the client's
+		if tenant != nil && tenant.OAuth2 != nil {
+			return false
+		}
+		// Tokens issued for this server are only passed on when the header
+		// is listed explicitly
+		if authEnabled() && !containsString(FORWARD_HEADERS, name) {
+			return false
+		}
+	}
+	return len(FORWARD_HEADERS) == 0 || containsString(FORWARD_HEADERS, name)
+}
+
+// copyUpstreamHeaders copies the inbound headers the header policy allows
+func copyUpstreamHeaders(tenant *Tenant, dst, src http.Header) {
+	for name, values := range src {
+		if !forwardHeader(tenant, name) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// filterUpstreamHeaders removes the headers the header policy does not allow
+func filterUpstreamHeaders(tenant *Tenant, header http.Header) {
+	for name := range header {
+		if !forwardHeader(tenant, name) {
+			header.Del(name)
+		}
+	}
+}
+
+// parseHeaderList reads a comma separated list of header names
+func parseHeaderList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = appendUnique(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// oauth2Config gets upstream access tokens with the OAuth2 client
+// credentials grant. Tokens are cached until shortly before they expire.
+type oauth2Config struct {
+	TokenURL     string `json:"tokenUrl"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	Scope        string `json:"scope,omitempty"`
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Tokens are renewed this long before they expire
+const TOKEN_REFRESH_MARGIN = 30 * time.Second
+
+// Lifetime assumed for tokens without expires_in
+const DEFAULT_TOKEN_LIFETIME = 5 * time.Minute
+
+func (c *oauth2Config) validate() error {
+	if c.TokenURL == "" || c.ClientID == "" {
+		return fmt.Errorf("OAuth2 client credentials need a token URL and client id")
+	}
+	if _, err := url.Parse(c.TokenURL); err != nil {
+		return fmt.Errorf("invalid OAuth2 token URL: %s", c.TokenURL)
+	}
+	return nil
+}
+
+// Token returns a cached access token or requests a new one
+func (c *oauth2Config) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expires.Add(-TOKEN_REFRESH_MARGIN)) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if c.Scope != "" {
+		form.Set("scope", c.Scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed with status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("invalid token response")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "Bearer") {
+		return "", fmt.Errorf("unsupported token type %s", token.TokenType)
+	}
+
+	lifetime := DEFAULT_TOKEN_LIFETIME
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	c.token = token.AccessToken
+	c.expires = time.Now().Add(lifetime)
+	log.Debug("fetched upstream access token", "token_url", c.TokenURL, "expires_in", lifetime)
+	return c.token, nil
+}
+
+// setCredentials adds the tenant's upstream credentials to a request
+func (t *Tenant) setCredentials(ctx context.Context, header http.Header) error {
+	if t.OAuth2 == nil {
+		return nil
+	}
+	token, err := t.OAuth2.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get upstream access token: %w", err)
+	}
+	header.Set("Authorization", "Bearer "+token)
+	return nil
+}
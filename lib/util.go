@@ -2,13 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func OperationOutcome(code string, text string, diagnostics *string) []byte {
@@ -32,7 +34,7 @@ func OperationOutcome(code string, text string, diagnostics *string) []byte {
 	}
 
 	// Remove empty values
-	removeEmpties(outcome)
+	removeEmpties(nil, outcome)
 
 	body, err := json.Marshal(outcome)
 	if err != nil {
@@ -43,18 +45,34 @@ func OperationOutcome(code string, text string, diagnostics *string) []byte {
 	return body
 }
 
+// GqlRequest sends a GraphQL request to the upstream of the tenant origReq
+// was routed to
 func GqlRequest(gql string, profile string, origReq *http.Request) (*http.Response, error) {
+	return GqlRequestTo(TenantFromRequest(origReq), gql, profile, origReq)
+}
+
+func GqlRequestTo(tenant *Tenant, gql string, profile string, origReq *http.Request) (*http.Response, error) {
 	ctxLog := LoggerFromRequest(origReq)
 
-	if LOG_LEVEL < 0 {
-		fmt.Printf("---------\n%s\n---------\n", gql)
-	}
+	ctxLog.Debug("GraphQL query", "graphql", gql)
 
 	query := fmt.Sprintf(`{"query": %q}`, gql)
+	upstreamQueryBytes.Observe(float64(len(query)), tenantLabel(tenant))
+
+	url := fmt.Sprintf("%s/$graphql?_profile=%s", tenant.UpstreamBase(), profile)
 
-	url := fmt.Sprintf("%s/$graphql?_profile=%s", upstream, profile)
+	ctx := context.Background()
+	if origReq != nil {
+		ctx = origReq.Context()
+	}
+	ctx, gqlSpan := startSpan(ctx, "GraphQL", SPAN_KIND_CLIENT)
+	defer gqlSpan.End()
+	gqlSpan.SetAttributes("server.address", tenant.Upstream, "graphql.query_bytes", len(query))
+	if profile != "" {
+		gqlSpan.SetAttributes("fhir.profile", profile)
+	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte(query)))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer([]byte(query)))
 
 	if err != nil {
 		ctxLog.Error("Error creating request:", "error", err)
@@ -62,55 +80,34 @@ func GqlRequest(gql string, profile string, origReq *http.Request) (*http.Respon
 	}
 
 	if origReq != nil {
-		copyHeaders(req.Header, origReq.Header)
+		copyUpstreamHeaders(tenant, req.Header, origReq.Header)
 		addForwardedFor(req)
 	}
 
+	tenant.setHeaders(req.Header)
+	if err := tenant.setCredentials(ctx, req.Header); err != nil {
+		ctxLog.Error("Error authenticating upstream request:", "error", err)
+		return nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", GQL_ACCEPT_HEADER)
-	resp, err := client.Do(req)
+	injectTraceContext(ctx, req.Header)
+	start := time.Now()
+	resp, err := httpClient(origReq).Do(req)
+	upstreamDuration.Observe(time.Since(start).Seconds(), tenantLabel(tenant))
 	if err != nil {
+		upstreamErrors.Inc(tenantLabel(tenant), "transport")
+		gqlSpan.SetError(err.Error())
 		ctxLog.Error("Error sending request:", "error", err)
 		return resp, err
 	}
-
-	return resp, nil
-}
-
-func ProxyRequest(w http.ResponseWriter, origReq *http.Request) {
-	ctxLog := LoggerFromRequest(origReq)
-
-	url := fmt.Sprintf("%s%s", upstream, origReq.URL.Path)
-
-	proxyReq, err := http.NewRequest(origReq.Method, url, origReq.Body)
-	if err != nil {
-		SendError(w, "Failed to create proxy request", http.StatusInternalServerError)
-		return
-	}
-
-	if origReq != nil {
-		ctxLog.Info("Proxying request")
-		copyHeaders(proxyReq.Header, origReq.Header)
-		addForwardedFor(proxyReq)
+	gqlSpan.SetAttributes("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		upstreamErrors.Inc(tenantLabel(tenant), "status")
+		gqlSpan.SetError(http.StatusText(resp.StatusCode))
 	}
 
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		ctxLog.Error("Error sending proxy request upstream:", "error", err)
-		SendError(w, "Failed to send proxy request", http.StatusServiceUnavailable)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Copy response headers
-	for name, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(name, value)
-		}
-	}
-
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	return resp, nil
 }
 
 // getEnv retrieves the value of the environment variable named by the key
@@ -122,6 +119,18 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// getEnvInt reads a positive integer from the environment, falling back on
+// invalid values
+func getEnvInt(key string, fallback int) int {
+	valueStr := getEnv(key, strconv.Itoa(fallback))
+	value, err := strconv.Atoi(valueStr)
+	if err != nil || value < 1 {
+		log.Warn(fmt.Sprintf("Invalid %s value, using default: %d", key, fallback), "value", valueStr)
+		return fallback
+	}
+	return value
+}
+
 // Extract client IP from X-Forwarded-For or RemoteAddr
 func clientIP(r *http.Request) string {
 	if xf := r.Header.Get("X-Forwarded-For"); xf != "" {